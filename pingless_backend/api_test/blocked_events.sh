@@ -0,0 +1,31 @@
+#!/bin/bash
+
+# A blocked user must not see the profile changes of the blocker on
+# /api/events. BLOCKER_TOKEN blocks BLOCKED_USER, changes the bio, and the
+# event stream of BLOCKED_TOKEN is checked for it.
+#   BLOCKER_TOKEN=... BLOCKED_TOKEN=... BLOCKED_USER=... ./blocked_events.sh
+
+API_BASE_URL="http://127.0.0.1:3000"
+BIO="hidden from blocked $RANDOM"
+
+curl -s -o /dev/null -X POST "${API_BASE_URL}/api/user/block" \
+  -H "Authorization: Bearer ${BLOCKER_TOKEN}" \
+  -d "{\"username\": \"${BLOCKED_USER}\"}"
+
+STREAM=$(mktemp)
+curl -s -N --max-time 3 "${API_BASE_URL}/api/events" \
+  -H "Authorization: Bearer ${BLOCKED_TOKEN}" > "$STREAM" &
+sleep 1
+
+curl -s -o /dev/null -X POST "${API_BASE_URL}/api/user/profile/update" \
+  -H "Authorization: Bearer ${BLOCKER_TOKEN}" \
+  -d "{\"bio\": \"${BIO}\"}"
+wait
+
+if grep -q "$BIO" "$STREAM"; then
+    echo "FAIL: the blocked user got the USER_UPDATE"
+    rm -f "$STREAM"
+    exit 1
+fi
+echo "OK: the blocked user did not get the USER_UPDATE"
+rm -f "$STREAM"
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+/*
+NOTE : Mock OpenID Connect provider for testing /api/user/oidc/*
+
+Every authorize request is approved straight away for the current mock user.
+The user can be changed with POST /mock/user, see api_test/oidc.hurl.
+
+	go run ./api_test/mock_idp -addr 127.0.0.1:4000 -client-id pingless
+
+and in .env
+
+	OIDC_ISSUER=http://127.0.0.1:4000
+	OIDC_CLIENT_ID=pingless
+	OIDC_CLIENT_SECRET=secret
+	OIDC_REDIRECT_URL=http://127.0.0.1:3000/api/user/oidc/callback
+	OIDC_ROLE_MAP=admins:Owner,members:Member
+*/
+
+type mockUser struct {
+	Sub           string   `json:"sub"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Username      string   `json:"preferred_username"`
+	Groups        []string `json:"groups"`
+}
+
+type pendingCode struct {
+	clientID    string
+	redirectURI string
+	nonce       string
+	challenge   string
+	user        mockUser
+}
+
+var (
+	addr         = flag.String("addr", "127.0.0.1:4000", "listen address")
+	clientID     = flag.String("client-id", "pingless", "accepted client id")
+	clientSecret = flag.String("client-secret", "secret", "accepted client secret")
+
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	user  = mockUser{Sub: "mock-1", Email: "sso@example.com", EmailVerified: true, Username: "sso", Groups: []string{"members"}}
+	codes = map[string]pendingCode{}
+)
+
+const kid = "mock-key"
+
+func main() {
+	flag.Parse()
+
+	var err error
+	if key, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		log.Fatal(err)
+	}
+
+	http.HandleFunc("/.well-known/openid-configuration", discovery)
+	http.HandleFunc("/authorize", authorize)
+	http.HandleFunc("/token", token)
+	http.HandleFunc("/jwks", jwks)
+	http.HandleFunc("/mock/user", setUser)
+
+	log.Println("mock IdP on http://" + *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
+
+func issuer() string {
+	return "http://" + *addr
+}
+
+func discovery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"issuer":                                issuer(),
+		"authorization_endpoint":                issuer() + "/authorize",
+		"token_endpoint":                        issuer() + "/token",
+		"jwks_uri":                              issuer() + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("response_type") != "code" || q.Get("client_id") != *clientID || q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || redirect.Host == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	code := random()
+	mu.Lock()
+	codes[code] = pendingCode{
+		clientID:    q.Get("client_id"),
+		redirectURI: q.Get("redirect_uri"),
+		nonce:       q.Get("nonce"),
+		challenge:   q.Get("code_challenge"),
+		user:        user,
+	}
+	mu.Unlock()
+
+	params := redirect.Query()
+	params.Set("code", code)
+	params.Set("state", q.Get("state"))
+	redirect.RawQuery = params.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, "invalid_request")
+		return
+	}
+	id, secret, _ := r.BasicAuth()
+	id, _ = url.QueryUnescape(id)
+	secret, _ = url.QueryUnescape(secret)
+	if id != *clientID || secret != *clientSecret {
+		tokenError(w, "invalid_client")
+		return
+	}
+
+	mu.Lock()
+	pending, ok := codes[r.PostForm.Get("code")]
+	delete(codes, r.PostForm.Get("code"))
+	mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || pending.clientID != id || pending.redirectURI != r.PostForm.Get("redirect_uri") ||
+		base64.RawURLEncoding.EncodeToString(sum[:]) != pending.challenge {
+		tokenError(w, "invalid_grant")
+		return
+	}
+
+	now := time.Now()
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":                issuer(),
+		"aud":                id,
+		"sub":                pending.user.Sub,
+		"email":              pending.user.Email,
+		"email_verified":     pending.user.EmailVerified,
+		"preferred_username": pending.user.Username,
+		"groups":             pending.user.Groups,
+		"nonce":              pending.nonce,
+		"iat":                now.Unix(),
+		"exp":                now.Add(5 * time.Minute).Unix(),
+	})
+	idToken.Header["kid"] = kid
+	signed, err := idToken.SignedString(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token": random(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     signed,
+	})
+}
+
+func jwks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": kid,
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+}
+
+// setUser changes who the next authorize request logs in as
+func setUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var next mockUser
+	if err := json.NewDecoder(r.Body).Decode(&next); err != nil || strings.TrimSpace(next.Sub) == "" {
+		http.Error(w, "invalid user", http.StatusBadRequest)
+		return
+	}
+	mu.Lock()
+	user = next
+	mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func tokenError(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+func random() string {
+	buf := make([]byte, 24)
+	rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
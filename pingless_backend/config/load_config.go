@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"log"
 	"strconv"
 
@@ -17,6 +18,46 @@ type Config struct {
 	EmailHost  string `env:"EMAIL_HOST" env-required:"true"`
 	EmailPort  string `env:"EMAIL_PORT" env-required:"true"`
 	GifAllowed string `env:"GIF_ALLOWED" envDefault:"true"`
+
+	// Comma separated CIDRs of the proxies allowed to set X-Real-IP and
+	// X-Forwarded-For, the headers of anyone else are ignored
+	TrustedProxies string `env:"TRUSTED_PROXIES"`
+
+	// Address users reach the server at, https://chat.example.com. A profile
+	// link is verified when its page links to PUBLIC_URL/users/<username>
+	// with rel="me", nothing is verified while it is empty.
+	PublicURL string `env:"PUBLIC_URL"`
+
+	// Role the owner keeps after handing the server to someone else
+	OwnerTransferRole string `env:"OWNER_TRANSFER_ROLE" envDefault:"Member"`
+
+	// OpenID Connect login, disabled while OIDC_ISSUER is empty.
+	// OIDC_ROLE_MAP is "group:Role Name,other-group:Other Role", the user
+	// has every mapped role of the groups they are in and none of the others.
+	OidcIssuer        string `env:"OIDC_ISSUER"`
+	OidcClientID      string `env:"OIDC_CLIENT_ID"`
+	OidcClientSecret  string `env:"OIDC_CLIENT_SECRET"`
+	OidcRedirectURL   string `env:"OIDC_REDIRECT_URL"`
+	OidcGroupsClaim   string `env:"OIDC_GROUPS_CLAIM" envDefault:"groups"`
+	OidcRoleMap       string `env:"OIDC_ROLE_MAP"`
+	OidcAutoProvision bool   `env:"OIDC_AUTO_PROVISION" envDefault:"true"`
+}
+
+// String is what main logs, the SMTP password and the OIDC client secret
+// are left out
+func (c Config) String() string {
+	type plain Config
+	redacted := plain(c)
+	redacted.Password = redact(redacted.Password)
+	redacted.OidcClientSecret = redact(redacted.OidcClientSecret)
+	return fmt.Sprintf("%+v", redacted)
+}
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "[REDACTED]"
 }
 
 func LoadConfig(db *sqlx.DB) Config {
@@ -36,6 +77,15 @@ func LoadConfig(db *sqlx.DB) Config {
 	saveSetting(db, "emailHost", cfg.EmailHost)
 	saveSetting(db, "emailPort", cfg.EmailPort)
 	saveSetting(db, "GifAllowed", cfg.GifAllowed)
+	saveSetting(db, "ownerTransferRole", cfg.OwnerTransferRole)
+	saveSetting(db, "publicURL", cfg.PublicURL)
+	saveSetting(db, "oidcIssuer", cfg.OidcIssuer)
+	saveSetting(db, "oidcClientID", cfg.OidcClientID)
+	saveSetting(db, "oidcClientSecret", cfg.OidcClientSecret)
+	saveSetting(db, "oidcRedirectURL", cfg.OidcRedirectURL)
+	saveSetting(db, "oidcGroupsClaim", cfg.OidcGroupsClaim)
+	saveSetting(db, "oidcRoleMap", cfg.OidcRoleMap)
+	saveSetting(db, "oidcAutoProvision", boolToStr(cfg.OidcAutoProvision))
 	return cfg
 }
 
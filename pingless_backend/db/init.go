@@ -1,6 +1,10 @@
 package db
 
 import (
+	"fmt"
+	"pingless/internal/permissions"
+	"strings"
+
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -41,9 +45,6 @@ func makeMigration(db *sqlx.DB) error {
 	if err := createServerSettingsTable(db); err != nil {
 		return err
 	}
-	if err := createPermissionTable(db); err != nil {
-		return err
-	}
 	if err := createRoleTable(db); err != nil {
 		return err
 	}
@@ -53,6 +54,242 @@ func makeMigration(db *sqlx.DB) error {
 	if err := createImageTable(db); err != nil {
 		return err
 	}
+	if err := createRefreshTokenTable(db); err != nil {
+		return err
+	}
+	if err := createSessionTable(db); err != nil {
+		return err
+	}
+	if _, err := addColumnIfMissing(db, "users", "password_changed_at", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := createOneTimeCodeTable(db); err != nil {
+		return err
+	}
+	if err := createMfaTables(db); err != nil {
+		return err
+	}
+	if _, err := addColumnIfMissing(db, "sessions", "mfa", "BOOLEAN NOT NULL DEFAULT FALSE"); err != nil {
+		return err
+	}
+	if err := createAuthThrottleTable(db); err != nil {
+		return err
+	}
+	if _, err := addColumnIfMissing(db, "email_verifications", "attempts", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := createInviteTable(db); err != nil {
+		return err
+	}
+	if err := createOidcTables(db); err != nil {
+		return err
+	}
+	if err := createSigningKeyTable(db); err != nil {
+		return err
+	}
+	if err := createPersonalAccessTokenTable(db); err != nil {
+		return err
+	}
+	if err := createRegistrationTicketTable(db); err != nil {
+		return err
+	}
+	if err := createChatTables(db); err != nil {
+		return err
+	}
+	if err := createEventLogTable(db); err != nil {
+		return err
+	}
+	if _, err := addColumnIfMissing(db, "event_log", "audience", "TEXT"); err != nil {
+		return err
+	}
+	if _, err := addColumnIfMissing(db, "users", "custom_status", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if _, err := addColumnIfMissing(db, "users", "custom_status_expires_at", "DATETIME"); err != nil {
+		return err
+	}
+	if err := createDmTables(db); err != nil {
+		return err
+	}
+	if err := createRelationshipTables(db); err != nil {
+		return err
+	}
+	if err := createEmojiTable(db); err != nil {
+		return err
+	}
+	if err := addProfileColumns(db); err != nil {
+		return err
+	}
+	if err := convertPermissionsToBitfield(db); err != nil {
+		return err
+	}
+	if err := createChannelOverwriteTable(db); err != nil {
+		return err
+	}
+	if err := createUserRoleTable(db); err != nil {
+		return err
+	}
+	if _, err := addColumnIfMissing(db, "oidc_logins", "link_user_id", "INTEGER"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Servers created before the bitfield have a permissions table with a
+// boolean column per permission, each role pointing to its row. Roles are
+// rebuilt with the bits of the columns that were set, Owner gets every bit
+// and every role gets to see and send in channels as before. Older servers
+// may miss the latest columns and the color/position of roles.
+func convertPermissionsToBitfield(db *sqlx.DB) error {
+	var old bool
+	err := db.Get(&old, `SELECT EXISTS(SELECT 1 FROM pragma_table_info('roles') WHERE name = 'permission_id')`)
+	if err != nil || !old {
+		return err
+	}
+
+	bits := map[string]int64{
+		"can_server_setting":  permissions.SERVER_SETTINGS,
+		"can_see_server_logs": permissions.SEE_SERVER_LOGS,
+		"can_create_invite":   permissions.CREATE_INVITE,
+		"can_manage_channels": permissions.MANAGE_CHANNELS,
+		"can_manage_messages": permissions.MANAGE_MESSAGES,
+		"can_manage_emojis":   permissions.MANAGE_EMOJIS,
+		"can_manage_roles":    permissions.MANAGE_ROLES,
+	}
+	var columns []string
+	if err := db.Select(&columns, `SELECT name FROM pragma_table_info('permissions')`); err != nil {
+		return err
+	}
+	// Built from the names above only, never from the table
+	bitfield := fmt.Sprint(permissions.DEFAULT)
+	for _, column := range columns {
+		if bit, ok := bits[column]; ok {
+			bitfield += fmt.Sprintf(" | (CASE WHEN p.%s THEN %d ELSE 0 END)", column, bit)
+		}
+	}
+	color, position := "''", "0"
+	if err := db.Select(&columns, `SELECT name FROM pragma_table_info('roles')`); err != nil {
+		return err
+	}
+	for _, column := range columns {
+		switch column {
+		case "color":
+			color = "r.color"
+		case "position":
+			position = "r.position"
+		}
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(strings.Replace(roleSchema, "roles", "roles_new", 1)); err != nil {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf(`
+		INSERT INTO roles_new (id, name, description, color, position, permissions)
+		SELECT r.id, r.name, r.description, %s, %s,
+			CASE WHEN r.id = %d THEN %d ELSE %s END
+		FROM roles r
+		LEFT JOIN permissions p ON r.permission_id = p.id`,
+		color, position, permissions.OWNER_ROLE, permissions.ALL, bitfield))
+	if err != nil {
+		return err
+	}
+	for _, stmt := range []string{
+		"DROP TABLE roles",
+		"ALTER TABLE roles_new RENAME TO roles",
+		"DROP TABLE permissions",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// A user has any number of roles and always Member (2). Servers from before
+// kept the one role of a user in users.role_id, it is copied here once and
+// no longer read.
+func createUserRoleTable(db *sqlx.DB) error {
+	var exists bool
+	if err := db.Get(&exists, `SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'user_roles')`); err != nil {
+		return err
+	}
+	var legacy bool
+	if err := db.Get(&legacy, `SELECT EXISTS(SELECT 1 FROM pragma_table_info('users') WHERE name = 'role_id')`); err != nil {
+		return err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	schema := `CREATE TABLE IF NOT EXISTS user_roles (
+    user_id INTEGER NOT NULL,
+    role_id INTEGER NOT NULL,
+    PRIMARY KEY (user_id, role_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (role_id) REFERENCES roles(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_user_roles_role ON user_roles(role_id);`
+	if _, err := tx.Exec(schema); err != nil {
+		return err
+	}
+	if exists {
+		return tx.Commit()
+	}
+	if legacy {
+		_, err := tx.Exec(`
+			INSERT OR IGNORE INTO user_roles (user_id, role_id)
+			SELECT u.id, u.role_id FROM users u JOIN roles r ON u.role_id = r.id`)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`INSERT OR IGNORE INTO user_roles (user_id, role_id) SELECT id, 2 FROM users`); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Overwrites change the permissions of a role or a user (target_type) in
+// one channel, allow and deny are bitfields
+func createChannelOverwriteTable(db *sqlx.DB) error {
+	schema := `CREATE TABLE IF NOT EXISTS channel_overwrites (
+    channel_id INTEGER NOT NULL,
+    target_type TEXT NOT NULL CHECK (target_type IN ('role', 'user')),
+    target_id INTEGER NOT NULL,
+    allow INTEGER NOT NULL DEFAULT 0,
+    deny INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (channel_id, target_type, target_id),
+    FOREIGN KEY (channel_id) REFERENCES channels(id) ON DELETE CASCADE
+);`
+	_, err := db.Exec(schema)
+	return err
+}
+
+// Extended profile, links is a JSON array of urls and verified_links the
+// ones among them whose page links back to the profile
+func addProfileColumns(db *sqlx.DB) error {
+	columns := [][2]string{
+		{"display_name", "TEXT NOT NULL DEFAULT ''"},
+		{"pronouns", "TEXT NOT NULL DEFAULT ''"},
+		{"accent_color", "TEXT NOT NULL DEFAULT ''"},
+		{"timezone", "TEXT NOT NULL DEFAULT ''"},
+		{"links", "TEXT NOT NULL DEFAULT '[]'"},
+		{"verified_links", "TEXT NOT NULL DEFAULT '[]'"},
+	}
+	for _, column := range columns {
+		if _, err := addColumnIfMissing(db, "users", column[0], column[1]); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 func makeUserMigration(db *sqlx.DB) error {
@@ -66,8 +303,6 @@ CREATE TABLE IF NOT EXISTS users (
 	
 	bio TEXT DEFAULT '',
 
-	role_id INTEGER NOT NULL DEFAULT 2 REFERENCES roles(id) ON DELETE SET NULL,
-
 	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
 );`
 
@@ -126,29 +361,21 @@ func createServerSettingsTable(db *sqlx.DB) error {
 	return err
 }
 
-func createPermissionTable(db *sqlx.DB) error {
-	schema := `CREATE TABLE IF NOT EXISTS permissions (
-	id INTEGER PRIMARY KEY AUTOINCREMENT,
-	can_server_setting BOOLEAN NOT NULL DEFAULT FALSE,
-	can_see_server_logs BOOLEAN NOT NULL DEFAULT FALSE
-);
-`
-	if _, err := db.Exec(schema); err != nil {
-		return err
-	}
-
-	return nil
-}
-func createRoleTable(db *sqlx.DB) error {
-	schema := `CREATE TABLE IF NOT EXISTS roles (
+// permissions is a bitfield, see internal/permissions. A higher position is
+// a higher role, the Owner role is above every other whatever its position
+// and Member stays at 0 below the others.
+const roleSchema = `CREATE TABLE IF NOT EXISTS roles (
 	id INTEGER PRIMARY KEY AUTOINCREMENT,
 	name TEXT NOT NULL UNIQUE,
 	description TEXT DEFAULT '',
-	permission_id INTEGER NOT NULL UNIQUE,
-	FOREIGN KEY (permission_id) REFERENCES permissions(id) ON DELETE CASCADE
+	color TEXT NOT NULL DEFAULT '',
+	position INTEGER NOT NULL DEFAULT 0,
+	permissions INTEGER NOT NULL DEFAULT 0
 );
 `
-	if _, err := db.Exec(schema); err != nil {
+
+func createRoleTable(db *sqlx.DB) error {
+	if _, err := db.Exec(roleSchema); err != nil {
 		return err
 	}
 
@@ -192,6 +419,349 @@ func createImageTable(db *sqlx.DB) error {
 	return nil
 }
 
+// refresh_tokens stores only the sha256 of each opaque refresh token.
+// Every login starts a new family_id; rotating a token marks the old row
+// as rotated and inserts its replacement in the same family.
+func createRefreshTokenTable(db *sqlx.DB) error {
+	schema := `CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    family_id TEXT NOT NULL,
+    rotated BOOLEAN NOT NULL DEFAULT FALSE,
+    revoked BOOLEAN NOT NULL DEFAULT FALSE,
+    expires_at DATETIME NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);`
+	if _, err := db.Exec(schema); err != nil {
+		return err
+	}
+
+	_, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family ON refresh_tokens(family_id)`)
+	return err
+}
+
+// sessions has one row per login (device). The session id is also used as
+// the refresh token family, so revoking a session kills its refresh tokens.
+func createSessionTable(db *sqlx.DB) error {
+	schema := `CREATE TABLE IF NOT EXISTS sessions (
+    id TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    user_agent TEXT NOT NULL DEFAULT '',
+    ip TEXT NOT NULL DEFAULT '',
+    revoked BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at DATETIME NOT NULL,
+    last_seen_at DATETIME NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);`
+	if _, err := db.Exec(schema); err != nil {
+		return err
+	}
+
+	_, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id)`)
+	return err
+}
+
+// one_time_codes holds emailed codes for account actions (e.g. password
+// reset). Unlike email_verifications they belong to an existing user and
+// are scoped by purpose, with at most one live code per purpose.
+func createOneTimeCodeTable(db *sqlx.DB) error {
+	schema := `CREATE TABLE IF NOT EXISTS one_time_codes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    purpose TEXT NOT NULL,
+    code_hash TEXT NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    consumed BOOLEAN NOT NULL DEFAULT FALSE,
+    expires_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL,
+    UNIQUE(user_id, purpose),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);`
+	_, err := db.Exec(schema)
+	return err
+}
+
+// user_mfa holds the TOTP secret of a user, enabled stays false until the
+// first code is confirmed. mfa_challenges are the short lived tickets handed
+// out by verify_user when the password was right but a code is still needed.
+func createMfaTables(db *sqlx.DB) error {
+	schema := `CREATE TABLE IF NOT EXISTS user_mfa (
+    user_id INTEGER PRIMARY KEY,
+    secret TEXT NOT NULL,
+    enabled BOOLEAN NOT NULL DEFAULT FALSE,
+    last_used_step INTEGER NOT NULL DEFAULT 0,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);`
+	if _, err := db.Exec(schema); err != nil {
+		return err
+	}
+
+	schema = `CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    code_hash TEXT NOT NULL,
+    used BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);`
+	if _, err := db.Exec(schema); err != nil {
+		return err
+	}
+
+	schema = `CREATE TABLE IF NOT EXISTS mfa_challenges (
+    token_hash TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    consumed BOOLEAN NOT NULL DEFAULT FALSE,
+    expires_at DATETIME NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);`
+	_, err := db.Exec(schema)
+	return err
+}
+
+// max_uses = 0 means unlimited, expires_at NULL means never
+func createInviteTable(db *sqlx.DB) error {
+	schema := `CREATE TABLE IF NOT EXISTS invites (
+    code TEXT PRIMARY KEY,
+    created_by INTEGER NOT NULL,
+    role_id INTEGER,
+    max_uses INTEGER NOT NULL DEFAULT 0,
+    uses INTEGER NOT NULL DEFAULT 0,
+    revoked BOOLEAN NOT NULL DEFAULT FALSE,
+    expires_at DATETIME,
+    created_at DATETIME NOT NULL,
+    FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (role_id) REFERENCES roles(id) ON DELETE SET NULL
+);`
+	_, err := db.Exec(schema)
+	return err
+}
+
+// oidc_logins holds the state of logins waiting for the IdP callback,
+// user_identities links an IdP account (issuer + sub) to a user
+func createOidcTables(db *sqlx.DB) error {
+	schema := `CREATE TABLE IF NOT EXISTS oidc_logins (
+    state TEXT PRIMARY KEY,
+    nonce TEXT NOT NULL,
+    code_verifier TEXT NOT NULL,
+    expires_at DATETIME NOT NULL
+);
+CREATE TABLE IF NOT EXISTS user_identities (
+    issuer TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    user_id INTEGER NOT NULL,
+    created_at DATETIME NOT NULL,
+    last_login_at DATETIME NOT NULL,
+    PRIMARY KEY (issuer, subject),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);`
+	_, err := db.Exec(schema)
+	return err
+}
+
+// signing_keys holds the Ed25519 seeds that sign access tokens, a NULL
+// retired_at marks the active key
+func createSigningKeyTable(db *sqlx.DB) error {
+	schema := `CREATE TABLE IF NOT EXISTS signing_keys (
+    kid TEXT PRIMARY KEY,
+    private_key TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    retired_at DATETIME
+);`
+	_, err := db.Exec(schema)
+	return err
+}
+
+// scopes is a comma separated list, expires_at NULL means never
+func createPersonalAccessTokenTable(db *sqlx.DB) error {
+	schema := `CREATE TABLE IF NOT EXISTS personal_access_tokens (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    token_prefix TEXT NOT NULL,
+    scopes TEXT NOT NULL,
+    mfa BOOLEAN NOT NULL DEFAULT FALSE,
+    revoked BOOLEAN NOT NULL DEFAULT FALSE,
+    expires_at DATETIME,
+    last_used_at DATETIME,
+    created_at DATETIME NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);`
+	_, err := db.Exec(schema)
+	return err
+}
+
+// registration_tickets makes the tickets from otp_verification single use
+func createRegistrationTicketTable(db *sqlx.DB) error {
+	schema := `CREATE TABLE IF NOT EXISTS registration_tickets (
+    jti TEXT PRIMARY KEY,
+    email VARCHAR(319) NOT NULL,
+    consumed BOOLEAN NOT NULL DEFAULT FALSE,
+    expires_at DATETIME NOT NULL
+);`
+	_, err := db.Exec(schema)
+	return err
+}
+
+// Ids of categories, channels and messages are snowflakes. A channel
+// without category is listed before the categories.
+func createChatTables(db *sqlx.DB) error {
+	schema := `CREATE TABLE IF NOT EXISTS categories (
+    id INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    position INTEGER NOT NULL DEFAULT 0,
+    created_at DATETIME NOT NULL
+);
+CREATE TABLE IF NOT EXISTS channels (
+    id INTEGER PRIMARY KEY,
+    category_id INTEGER,
+    name TEXT NOT NULL,
+    position INTEGER NOT NULL DEFAULT 0,
+    created_at DATETIME NOT NULL,
+    FOREIGN KEY (category_id) REFERENCES categories(id) ON DELETE SET NULL
+);
+CREATE TABLE IF NOT EXISTS messages (
+    id INTEGER PRIMARY KEY,
+    channel_id INTEGER NOT NULL,
+    author_id INTEGER NOT NULL,
+    content TEXT NOT NULL,
+    edited_at DATETIME,
+    created_at DATETIME NOT NULL,
+    FOREIGN KEY (channel_id) REFERENCES channels(id) ON DELETE CASCADE,
+    FOREIGN KEY (author_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_messages_channel ON messages(channel_id, id);`
+	_, err := db.Exec(schema)
+	return err
+}
+
+// Emoji names are unique whatever the case, :Cat: and :cat: would be the
+// same emoji to a reader
+func createEmojiTable(db *sqlx.DB) error {
+	schema := `CREATE TABLE IF NOT EXISTS emojis (
+    id INTEGER PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE COLLATE NOCASE,
+    file_name TEXT NOT NULL,
+    file_size INTEGER NOT NULL,
+    mime_type TEXT NOT NULL,
+    hash TEXT NOT NULL,
+    animated BOOLEAN NOT NULL DEFAULT FALSE,
+    created_by INTEGER,
+    created_at DATETIME NOT NULL,
+    FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+);`
+	_, err := db.Exec(schema)
+	return err
+}
+
+// A pending request is one row from the requester, friends have a row each
+// way so listing them is one lookup
+func createRelationshipTables(db *sqlx.DB) error {
+	schema := `CREATE TABLE IF NOT EXISTS relationships (
+    user_id INTEGER NOT NULL,
+    target_id INTEGER NOT NULL,
+    type TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (user_id, target_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (target_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_relationships_target ON relationships(target_id, type);
+CREATE TABLE IF NOT EXISTS blocks (
+    blocker_id INTEGER NOT NULL,
+    blocked_id INTEGER NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (blocker_id, blocked_id),
+    FOREIGN KEY (blocker_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (blocked_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_blocks_blocked ON blocks(blocked_id);`
+	_, err := db.Exec(schema)
+	return err
+}
+
+// A one to one conversation has dm_key "<smaller user id>:<bigger user id>"
+// so it exists only once, groups have none. last_activity_id is the id of the
+// conversation or of its newest message, whichever is newer.
+func createDmTables(db *sqlx.DB) error {
+	schema := `CREATE TABLE IF NOT EXISTS dm_conversations (
+    id INTEGER PRIMARY KEY,
+    dm_key TEXT UNIQUE,
+    is_group BOOLEAN NOT NULL DEFAULT FALSE,
+    last_message_id INTEGER,
+    last_activity_id INTEGER NOT NULL,
+    created_at DATETIME NOT NULL
+);
+CREATE TABLE IF NOT EXISTS dm_participants (
+    conversation_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    joined_at DATETIME NOT NULL,
+    PRIMARY KEY (conversation_id, user_id),
+    FOREIGN KEY (conversation_id) REFERENCES dm_conversations(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_dm_participants_user ON dm_participants(user_id);
+CREATE TABLE IF NOT EXISTS dm_messages (
+    id INTEGER PRIMARY KEY,
+    conversation_id INTEGER NOT NULL,
+    author_id INTEGER NOT NULL,
+    content TEXT NOT NULL,
+    edited_at DATETIME,
+    created_at DATETIME NOT NULL,
+    FOREIGN KEY (conversation_id) REFERENCES dm_conversations(id) ON DELETE CASCADE,
+    FOREIGN KEY (author_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_dm_messages_conversation ON dm_messages(conversation_id, id);`
+	_, err := db.Exec(schema)
+	return err
+}
+
+// event_log keeps the last events published, the id is the sequence
+// number clients resume from
+func createEventLogTable(db *sqlx.DB) error {
+	schema := `CREATE TABLE IF NOT EXISTS event_log (
+    id INTEGER PRIMARY KEY,
+    type TEXT NOT NULL,
+    data TEXT NOT NULL,
+    created_at DATETIME NOT NULL
+);`
+	_, err := db.Exec(schema)
+	return err
+}
+
+// auth_throttle counts failed logins/otp guesses per account, email or ip
+func createAuthThrottleTable(db *sqlx.DB) error {
+	schema := `CREATE TABLE IF NOT EXISTS auth_throttle (
+    key TEXT PRIMARY KEY,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure DATETIME NOT NULL,
+    locked_until DATETIME
+);`
+	_, err := db.Exec(schema)
+	return err
+}
+
+// addColumnIfMissing is used for columns added after a table was first
+// released, since sqlite has no ADD COLUMN IF NOT EXISTS. It reports
+// whether the column was added so callers can backfill it.
+func addColumnIfMissing(db *sqlx.DB, table, column, definition string) (bool, error) {
+	var exists bool
+	err := db.Get(&exists, `SELECT EXISTS(SELECT 1 FROM pragma_table_info(?) WHERE name = ?)`, table, column)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		return false, nil
+	}
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err == nil, err
+}
+
 func insertInitialRolesAndPermissions(db *sqlx.DB) error {
 	tx, err := db.Beginx()
 	if err != nil {
@@ -215,25 +785,12 @@ func insertInitialRolesAndPermissions(db *sqlx.DB) error {
 		return tx.Commit()
 	}
 
-	// Insert permissions
-	_, err = tx.Exec(`INSERT INTO permissions (can_server_setting,can_see_server_logs) VALUES (TRUE,TRUE);`)
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-
-	_, err = tx.Exec(`INSERT INTO permissions DEFAULT VALUES;`)
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-
-	// Insert roles (permission_id 1 = Owner, 2 = Member)
+	// Insert roles (1 = Owner, 2 = Member)
 	_, err = tx.Exec(`
-		INSERT INTO roles (name, description, permission_id) VALUES
-		('Owner', 'Full access to everything', 1),
-		('Member', 'Default user with basic access', 2);
-	`)
+		INSERT INTO roles (name, description, permissions) VALUES
+		('Owner', 'Full access to everything', ?),
+		('Member', 'Default user with basic access', ?);
+	`, permissions.ALL, permissions.DEFAULT)
 	if err != nil {
 		tx.Rollback()
 		return err
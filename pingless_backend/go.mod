@@ -4,15 +4,14 @@ go 1.24.3
 
 require (
 	github.com/caarlos0/env/v11 v11.3.1
+	github.com/chai2010/webp v1.4.0
+	github.com/go-chi/chi/v5 v5.2.2
+	github.com/golang-jwt/jwt/v5 v5.2.2
+	github.com/gorilla/websocket v1.5.3
+	github.com/jmoiron/sqlx v1.4.0
 	github.com/joho/godotenv v1.5.1
+	github.com/mattn/go-sqlite3 v1.14.28
+	golang.org/x/crypto v0.39.0
 )
 
-require (
-	github.com/chai2010/webp v1.4.0 // indirect
-	github.com/go-chi/chi/v5 v5.2.2 // indirect
-	github.com/golang-jwt/jwt/v5 v5.2.2 // indirect
-	github.com/jmoiron/sqlx v1.4.0 // indirect
-	github.com/mattn/go-sqlite3 v1.14.28 // indirect
-	golang.org/x/crypto v0.39.0 // indirect
-	golang.org/x/image v0.28.0 // indirect
-)
+require golang.org/x/image v0.28.0 // indirect
@@ -0,0 +1,230 @@
+package events
+
+import (
+	"encoding/json"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+NOTE : Event bus
+
+Handlers publish what they changed once it is committed. Every event is
+written to event_log with the next sequence number as id, then sent to the
+live subscribers (gateway and SSE connections). The log keeps the last
+EVENT_LOG_SIZE events so a client that was away for a while, even across a
+restart, can be sent what it missed instead of loading everything again.
+
+An event can be published to some users only (PublishTo), the others never
+see it, sequences they get are then not contiguous. USER_UPDATE goes through
+PublishUserUpdate so users blocked by its subject are left out.
+
+A subscriber that does not keep up is dropped (its channel is closed), it
+can come back with the last sequence it saw like any disconnected client.
+*/
+
+const (
+	EVENT_LOG_SIZE    = 10000
+	SUBSCRIBER_BUFFER = 256
+)
+
+// Event types
+const (
+	SERVER_UPDATE   = "SERVER_UPDATE"
+	USER_CREATE     = "USER_CREATE"
+	USER_UPDATE     = "USER_UPDATE"
+	CHANNELS_UPDATE = "CHANNELS_UPDATE"
+	EMOJIS_UPDATE   = "EMOJIS_UPDATE"
+	ROLES_UPDATE    = "ROLES_UPDATE"
+	MESSAGE_CREATE  = "MESSAGE_CREATE"
+	MESSAGE_UPDATE  = "MESSAGE_UPDATE"
+	MESSAGE_DELETE  = "MESSAGE_DELETE"
+	// Sent to the participants only
+	DM_CONVERSATION_CREATE = "DM_CONVERSATION_CREATE"
+	DM_MESSAGE_CREATE      = "DM_MESSAGE_CREATE"
+	DM_MESSAGE_UPDATE      = "DM_MESSAGE_UPDATE"
+	DM_MESSAGE_DELETE      = "DM_MESSAGE_DELETE"
+	RELATIONSHIP_UPDATE    = "RELATIONSHIP_UPDATE"
+)
+
+type Event struct {
+	Seq  int64
+	Type string
+	Data json.RawMessage
+	// Usernames the event is for, nil is everyone
+	Audience  []string
+	CreatedAt time.Time
+}
+
+func (event Event) For(username string) bool {
+	return event.Audience == nil || slices.Contains(event.Audience, username)
+}
+
+type Subscription struct {
+	C        <-chan Event
+	ch       chan Event
+	username string
+}
+
+var (
+	mu          sync.Mutex
+	seq         int64
+	subscribers = map[*Subscription]struct{}{}
+)
+
+// Init picks up the sequence where the log stopped
+func Init(db *sqlx.DB) error {
+	mu.Lock()
+	defer mu.Unlock()
+	return db.Get(&seq, "SELECT COALESCE(MAX(id), 0) FROM event_log")
+}
+
+func Publish(db *sqlx.DB, eventType string, data any) error {
+	return publish(db, nil, eventType, data)
+}
+
+// PublishTo sends the event to usernames only
+func PublishTo(db *sqlx.DB, usernames []string, eventType string, data any) error {
+	if usernames == nil {
+		usernames = []string{}
+	}
+	return publish(db, usernames, eventType, data)
+}
+
+// PublishUserUpdate sends update to everyone but the users its subject
+// blocked, they do not get to see the profile change
+func PublishUserUpdate(db *sqlx.DB, update UserUpdate) error {
+	var blocked bool
+	err := db.Get(&blocked, `
+		SELECT EXISTS(
+			SELECT 1 FROM blocks b
+			JOIN users u ON b.blocker_id = u.id
+			WHERE u.username = ?)`, update.Username)
+	if err != nil {
+		return err
+	}
+	if !blocked {
+		return Publish(db, USER_UPDATE, update)
+	}
+	var audience []string
+	err = db.Select(&audience, `
+		SELECT username FROM users
+		WHERE id NOT IN (
+			SELECT b.blocked_id FROM blocks b
+			JOIN users u ON b.blocker_id = u.id
+			WHERE u.username = ?)`, update.Username)
+	if err != nil {
+		return err
+	}
+	return PublishTo(db, audience, USER_UPDATE, update)
+}
+
+func publish(db *sqlx.DB, audience []string, eventType string, data any) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	var audienceList *string
+	if audience != nil {
+		list, err := json.Marshal(audience)
+		if err != nil {
+			return err
+		}
+		s := string(list)
+		audienceList = &s
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	event := Event{Seq: seq + 1, Type: eventType, Data: raw, Audience: audience, CreatedAt: time.Now()}
+	_, err = db.Exec("INSERT INTO event_log (id, type, data, audience, created_at) VALUES (?, ?, ?, ?, ?)",
+		event.Seq, event.Type, string(event.Data), audienceList, event.CreatedAt)
+	if err != nil {
+		return err
+	}
+	seq = event.Seq
+	if _, err := db.Exec("DELETE FROM event_log WHERE id <= ?", seq-EVENT_LOG_SIZE); err != nil {
+		return err
+	}
+
+	for sub := range subscribers {
+		if !event.For(sub.username) {
+			continue
+		}
+		select {
+		case sub.ch <- event:
+		default:
+			delete(subscribers, sub)
+			close(sub.ch)
+		}
+	}
+	return nil
+}
+
+// Seq returns the sequence of the last published event
+func Seq() int64 {
+	mu.Lock()
+	defer mu.Unlock()
+	return seq
+}
+
+// Subscribe returns the events for username published after the sequence
+// after, and a subscription for the ones to come. ok is false when some of
+// those events are not in the log anymore (or after was never reached), the
+// caller has to start over from Seq().
+func Subscribe(db *sqlx.DB, after int64, username string) (missed []Event, sub *Subscription, ok bool, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if after < 0 || after > seq {
+		return nil, nil, false, nil
+	}
+	if after < seq {
+		var oldest int64
+		if err := db.Get(&oldest, "SELECT COALESCE(MIN(id), 0) FROM event_log"); err != nil {
+			return nil, nil, false, err
+		}
+		if oldest == 0 || after < oldest-1 {
+			return nil, nil, false, nil
+		}
+		var rows []struct {
+			ID        int64     `db:"id"`
+			Type      string    `db:"type"`
+			Data      string    `db:"data"`
+			Audience  *string   `db:"audience"`
+			CreatedAt time.Time `db:"created_at"`
+		}
+		if err := db.Select(&rows, "SELECT id, type, data, audience, created_at FROM event_log WHERE id > ? ORDER BY id", after); err != nil {
+			return nil, nil, false, err
+		}
+		for _, row := range rows {
+			event := Event{Seq: row.ID, Type: row.Type, Data: json.RawMessage(row.Data), CreatedAt: row.CreatedAt}
+			if row.Audience != nil {
+				if err := json.Unmarshal([]byte(*row.Audience), &event.Audience); err != nil {
+					return nil, nil, false, err
+				}
+			}
+			if event.For(username) {
+				missed = append(missed, event)
+			}
+		}
+	}
+
+	ch := make(chan Event, SUBSCRIBER_BUFFER)
+	sub = &Subscription{C: ch, ch: ch, username: username}
+	subscribers[sub] = struct{}{}
+	return missed, sub, true, nil
+}
+
+func (sub *Subscription) Close() {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := subscribers[sub]; ok {
+		delete(subscribers, sub)
+		close(sub.ch)
+	}
+}
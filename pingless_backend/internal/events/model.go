@@ -0,0 +1,59 @@
+package events
+
+import "time"
+
+// Payloads of the events, chat events carry the chat response models
+
+// Only the fields that changed are set
+type ServerUpdate struct {
+	Name       string `json:"name,omitempty"`
+	Pfp        string `json:"pfp,omitempty"`
+	Banner     string `json:"banner,omitempty"`
+	Require2fa *bool  `json:"require_2fa,omitempty"`
+}
+
+type UserCreate struct {
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Only the fields that changed are set, an empty bio (or other text) is
+// sent as ""
+type UserUpdate struct {
+	Username      string        `json:"username"`
+	Bio           *string       `json:"bio,omitempty"`
+	DisplayName   *string       `json:"display_name,omitempty"`
+	Pronouns      *string       `json:"pronouns,omitempty"`
+	AccentColor   *string       `json:"accent_color,omitempty"`
+	Timezone      *string       `json:"timezone,omitempty"`
+	Links         *[]string     `json:"links,omitempty"`
+	VerifiedLinks *[]string     `json:"verified_links,omitempty"`
+	Role          *string       `json:"role,omitempty"`  // highest role
+	Roles         *[]int        `json:"roles,omitempty"` // role ids, highest first
+	Color         *string       `json:"color,omitempty"`
+	Pfp           string        `json:"pfp,omitempty"`
+	Banner        string        `json:"banner,omitempty"`
+	CustomStatus  *CustomStatus `json:"custom_status,omitempty"`
+}
+
+// An empty text is a cleared status
+type CustomStatus struct {
+	Text      string     `json:"text"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type MessageDelete struct {
+	ID        int64 `json:"id,string"`
+	ChannelID int64 `json:"channel_id,string"`
+}
+
+type DmMessageDelete struct {
+	ID             int64 `json:"id,string"`
+	ConversationID int64 `json:"conversation_id,string"`
+}
+
+// Status is the relationship with Username as the receiver sees it
+type RelationshipUpdate struct {
+	Username string `json:"username"`
+	Status   string `json:"status"`
+}
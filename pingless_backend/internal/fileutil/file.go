@@ -2,17 +2,20 @@ package fileutil
 
 import (
 	"crypto/md5"
+	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"image"
 	"io"
 	"log"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
 	"pingless/internal/auditlog"
+	"pingless/internal/events"
 	"time"
 
 	"github.com/chai2010/webp"
@@ -50,10 +53,20 @@ func NewFileUploadConfig(
 	}
 }
 
+// UploadedFile is a file saved by SaveUpload
+type UploadedFile struct {
+	FileName string
+	Path     string
+	Size     int64
+	MimeType string
+	Hash     string
+}
+
 func generateUniqueFileName(imageType, extension string) string {
 	timestamp := time.Now().Unix()
-	randomStr := fmt.Sprintf("%d", timestamp)[:8]
-	return fmt.Sprintf("%s_%d_%s%s", imageType, timestamp, randomStr, extension)
+	random := make([]byte, 4)
+	rand.Read(random)
+	return fmt.Sprintf("%s_%d_%s%s", imageType, timestamp, hex.EncodeToString(random), extension)
 }
 func generateFileHash(file multipart.File) (string, error) {
 	hash := md5.New()
@@ -131,47 +144,103 @@ func HandleFileUpload(w http.ResponseWriter, r *http.Request, db *sqlx.DB, confi
 		return
 	}
 
-	// Limit request body size before parsing
-	r.Body = http.MaxBytesReader(w, r.Body, config.maxFileSize)
-	err := r.ParseMultipartForm(config.maxFileSize)
+	var userID int
+	err := db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("File size exceeds %dMB", config.maxFileSize>>20), http.StatusRequestEntityTooLarge)
+		log.Println("User not found:", err)
+		http.Error(w, "User not found", http.StatusInternalServerError)
 		return
 	}
 
-	var userID int
-	err = db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID)
+	upload, ok := SaveUpload(w, r, config)
+	if !ok {
+		return
+	}
+
+	// Store image metadata in database
+	query := `
+		INSERT INTO images (user_id, image_type, file_name, file_size, mime_type, hash, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(user_id, image_type) DO UPDATE SET
+			file_name = excluded.file_name,
+			file_size = excluded.file_size,
+			mime_type = excluded.mime_type,
+			hash = excluded.hash,
+			updated_at = excluded.updated_at
+	`
+
+	now := time.Now()
+	_, err = db.Exec(query,
+		userID,
+		config.uploadSubDir, // image_type (pfp or banner)
+		upload.FileName,
+		upload.Size,
+		upload.MimeType,
+		upload.Hash,
+		now,
+		now,
+	)
 	if err != nil {
-		log.Println("User not found:", err)
-		http.Error(w, "User not found", http.StatusInternalServerError)
+		log.Println("Failed to store image metadata:", err)
+		http.Error(w, "Failed to store image metadata", http.StatusInternalServerError)
 		return
 	}
 
+	// Return JSON response with image URL
+	imageURL := fmt.Sprintf("/images/%s", upload.FileName)
+	update := events.UserUpdate{Username: username}
+	if config.uploadSubDir == "banner" {
+		update.Banner = imageURL
+	} else {
+		update.Pfp = imageURL
+	}
+	events.PublishUserUpdate(db, update)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message":   "File uploaded successfully",
+		"image_url": imageURL,
+		"file_name": upload.FileName,
+	})
+}
+
+// SaveUpload reads the form file of config, checks it and saves it under
+// uploads/<subdir>/ with a generated name. On failure the error is already
+// written to w and ok is false.
+func SaveUpload(w http.ResponseWriter, r *http.Request, config *FileUploadConfig) (upload *UploadedFile, ok bool) {
+	// Limit request body size before parsing
+	r.Body = http.MaxBytesReader(w, r.Body, config.maxFileSize)
+	err := r.ParseMultipartForm(config.maxFileSize)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("File size exceeds %s", sizeString(config.maxFileSize)), http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+
 	// Get the file
-	file, header, err := r.FormFile(config.formFieldName)
+	file, _, err := r.FormFile(config.formFieldName)
 	if err != nil {
 		http.Error(w, "Cannot read uploaded image", http.StatusBadRequest)
-		return
+		return nil, false
 	}
 	defer file.Close()
 
 	// Check MIME type
 	if err := CheckMimeType(file, config.allowedMimeTypes); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+		return nil, false
 	}
 
 	fileName := generateUniqueFileName(config.uploadSubDir, config.fileExtension)
 	fileHash, err := generateFileHash(file)
 	if err != nil {
 		http.Error(w, "Cannot hash the value", http.StatusInternalServerError)
-		return
+		return nil, false
 	}
 
 	// Rewind file
 	if _, err := file.Seek(0, io.SeekStart); err != nil {
 		http.Error(w, "Failed to rewind file", http.StatusInternalServerError)
-		return
+		return nil, false
 	}
 
 	// Save file with generated filename
@@ -184,54 +253,30 @@ func HandleFileUpload(w http.ResponseWriter, r *http.Request, db *sqlx.DB, confi
 	if err != nil {
 		log.Println("File saving failed:", err)
 		http.Error(w, "Failed to save file", http.StatusInternalServerError)
-		return
+		return nil, false
 	}
 
 	fileInfo, err := os.Stat(dstPath)
 	if err != nil {
 		log.Println("Failed to get file info:", err)
 		http.Error(w, "Failed to process file", http.StatusInternalServerError)
-		return
+		return nil, false
 	}
 
-	// Store image metadata in database
-	query := `
-		INSERT INTO images (user_id, image_type, file_name, file_size, mime_type, hash, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
-		ON CONFLICT(user_id, image_type) DO UPDATE SET
-			file_name = excluded.file_name,
-			file_size = excluded.file_size,
-			mime_type = excluded.mime_type,
-			hash = excluded.hash,
-			updated_at = excluded.updated_at
-	`
+	return &UploadedFile{
+		FileName: fileName,
+		Path:     dstPath,
+		Size:     fileInfo.Size(),
+		MimeType: mime.TypeByExtension(config.fileExtension),
+		Hash:     fileHash,
+	}, true
+}
 
-	now := time.Now()
-	_, err = db.Exec(query,
-		userID,
-		config.uploadSubDir, // image_type (pfp or banner)
-		fileName,
-		fileInfo.Size(),
-		header.Header.Get("Content-Type"),
-		fileHash,
-		now,
-		now,
-	)
-	if err != nil {
-		log.Println("Failed to store image metadata:", err)
-		http.Error(w, "Failed to store image metadata", http.StatusInternalServerError)
-		return
+func sizeString(size int64) string {
+	if size < 1<<20 {
+		return fmt.Sprintf("%dKB", size>>10)
 	}
-
-	// Return JSON response with image URL
-	imageURL := fmt.Sprintf("/images/%s", fileName)
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusAccepted)
-	json.NewEncoder(w).Encode(map[string]string{
-		"message":   "File uploaded successfully",
-		"image_url": imageURL,
-		"file_name": fileName,
-	})
+	return fmt.Sprintf("%dMB", size>>20)
 }
 
 func ServerFileUpload(w http.ResponseWriter, r *http.Request, db *sqlx.DB, config *FileUploadConfig) {
@@ -306,6 +351,15 @@ func ServerFileUpload(w http.ResponseWriter, r *http.Request, db *sqlx.DB, confi
 			//TODO When add image link can be done when we serve image
 		},
 	})
+	// uploads/ is served as /images/
+	imageURL := fmt.Sprintf("/images/server/%s/server%s", config.uploadSubDir, config.fileExtension)
+	update := events.ServerUpdate{}
+	if config.uploadSubDir == "banner" {
+		update.Banner = imageURL
+	} else {
+		update.Pfp = imageURL
+	}
+	events.Publish(db, events.SERVER_UPDATE, update)
 	// Success
 	w.WriteHeader(http.StatusAccepted)
 	w.Write([]byte("File uploaded successfully\n"))
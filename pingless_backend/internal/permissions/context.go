@@ -0,0 +1,16 @@
+package permissions
+
+import "context"
+
+// Server wide permissions of the caller, resolved once per request
+type contextKey struct{}
+
+func WithPermissions(ctx context.Context, perms int64) context.Context {
+	return context.WithValue(ctx, contextKey{}, perms)
+}
+
+// FromContext returns the permissions cached by WithPermissions
+func FromContext(ctx context.Context) (int64, bool) {
+	perms, ok := ctx.Value(contextKey{}).(int64)
+	return perms, ok
+}
@@ -0,0 +1,235 @@
+package permissions
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+NOTE : Permission bitfield
+
+A role has a 64 bit set of permissions, adding one is adding a bit here, no
+schema change. Bitfields are sent as strings in JSON, like snowflakes.
+
+Channels can change the permissions their members get there with
+overwrites, for a role or for one user. Compute is the one place effective
+permissions are worked out:
+
+ 1. the union of the permissions of every role of the user (Owner has all)
+ 2. in a channel, the deny then the allow of the overwrites of those roles
+ 3. then the deny and allow of the overwrite of the user
+
+Server wide permissions are resolved without channel (channel id 0).
+*/
+
+const (
+	SERVER_SETTINGS int64 = 1 << iota
+	SEE_SERVER_LOGS
+	CREATE_INVITE
+	MANAGE_CHANNELS
+	MANAGE_MESSAGES
+	MANAGE_EMOJIS
+	MANAGE_ROLES
+	VIEW_CHANNEL
+	SEND_MESSAGES
+)
+
+const (
+	ALL int64 = SEND_MESSAGES<<1 - 1
+	// What Member and new roles start with
+	DEFAULT int64 = VIEW_CHANNEL | SEND_MESSAGES
+	// What an overwrite can change
+	CHANNEL int64 = VIEW_CHANNEL | SEND_MESSAGES | MANAGE_MESSAGES
+)
+
+// NAMES are the bits in order, for audit_log
+var NAMES = []string{
+	"server_settings",
+	"see_server_logs",
+	"create_invite",
+	"manage_channels",
+	"manage_messages",
+	"manage_emojis",
+	"manage_roles",
+	"view_channel",
+	"send_messages",
+}
+
+// Roles every server has, Owner is above everything and Member is given to
+// everybody
+const (
+	OWNER_ROLE  = 1
+	MEMBER_ROLE = 2
+)
+
+// Overwrite targets
+const (
+	TARGET_ROLE = "role"
+	TARGET_USER = "user"
+)
+
+type Overwrite struct {
+	ChannelID  int64  `db:"channel_id"`
+	TargetType string `db:"target_type"`
+	TargetID   int    `db:"target_id"`
+	Allow      int64  `db:"allow"`
+	Deny       int64  `db:"deny"`
+}
+
+// Member is what Compute needs to know of a user
+type Member struct {
+	UserID   int
+	Username string
+	RoleIDs  []int
+	Base     int64 // union of the permissions of the roles
+}
+
+func (m Member) Owner() bool {
+	return slices.Contains(m.RoleIDs, OWNER_ROLE)
+}
+
+// Compute returns the permissions of member in a channel with overwrites,
+// nil overwrites is server wide
+func Compute(member Member, overwrites []Overwrite) int64 {
+	if member.Owner() {
+		return ALL
+	}
+	perms := member.Base
+	var allow, deny int64
+	for _, o := range overwrites {
+		if o.TargetType == TARGET_ROLE && slices.Contains(member.RoleIDs, o.TargetID) {
+			allow |= o.Allow
+			deny |= o.Deny
+		}
+	}
+	perms = perms&^deny | allow
+	for _, o := range overwrites {
+		if o.TargetType == TARGET_USER && o.TargetID == member.UserID {
+			perms = perms&^o.Deny | o.Allow
+		}
+	}
+	return perms
+}
+
+// Has reports whether perms has every bit of want
+func Has(perms int64, want int64) bool {
+	return perms&want == want
+}
+
+// Names lists the bits set in perms, comma separated
+func Names(perms int64) string {
+	names := []string{}
+	for i, name := range NAMES {
+		if perms&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// Resolve returns the permissions of username in channelID (0 for server
+// wide)
+func Resolve(q sqlx.Queryer, username string, channelID int64) (int64, error) {
+	members, err := loadMembers(q, "u.username = ?", username)
+	if err != nil || len(members) == 0 {
+		return 0, err
+	}
+	var overwrites []Overwrite
+	if channelID != 0 {
+		overwrites, err = ChannelOverwrites(q, channelID)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return Compute(members[0], overwrites), nil
+}
+
+// Audience returns who has want in channelID, nil when everybody does.
+// Every user is only loaded when the channel has overwrites or some role
+// lacks want, most sends skip it.
+func Audience(q sqlx.Queryer, channelID int64, want int64) ([]string, error) {
+	overwrites, err := ChannelOverwrites(q, channelID)
+	if err != nil {
+		return nil, err
+	}
+	if len(overwrites) == 0 {
+		var everyRole bool
+		err := sqlx.Get(q, &everyRole, "SELECT NOT EXISTS(SELECT 1 FROM roles WHERE id != ? AND permissions & ? != ?)", OWNER_ROLE, want, want)
+		if err != nil || everyRole {
+			return nil, err
+		}
+	}
+	members, err := Members(q)
+	if err != nil {
+		return nil, err
+	}
+	audience := []string{}
+	for _, member := range members {
+		if Has(Compute(member, overwrites), want) {
+			audience = append(audience, member.Username)
+		}
+	}
+	if len(audience) == len(members) {
+		return nil, nil
+	}
+	return audience, nil
+}
+
+// Members returns every user with their roles
+func Members(q sqlx.Queryer) ([]Member, error) {
+	return loadMembers(q, "1 = 1")
+}
+
+func loadMembers(q sqlx.Queryer, where string, args ...any) ([]Member, error) {
+	var rows []struct {
+		UserID      int    `db:"id"`
+		Username    string `db:"username"`
+		RoleID      int    `db:"role_id"`
+		Permissions int64  `db:"permissions"`
+	}
+	err := sqlx.Select(q, &rows, `
+		SELECT u.id, u.username, r.id AS role_id, r.permissions
+		FROM users u
+		JOIN user_roles ur ON ur.user_id = u.id
+		JOIN roles r ON ur.role_id = r.id
+		WHERE `+where+`
+		ORDER BY u.id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	members := []Member{}
+	for _, row := range rows {
+		if n := len(members); n > 0 && members[n-1].UserID == row.UserID {
+			members[n-1].RoleIDs = append(members[n-1].RoleIDs, row.RoleID)
+			members[n-1].Base |= row.Permissions
+			continue
+		}
+		members = append(members, Member{UserID: row.UserID, Username: row.Username, RoleIDs: []int{row.RoleID}, Base: row.Permissions})
+	}
+	return members, nil
+}
+
+func ChannelOverwrites(q sqlx.Queryer, channelID int64) ([]Overwrite, error) {
+	overwrites := []Overwrite{}
+	err := sqlx.Select(q, &overwrites, `
+		SELECT channel_id, target_type, target_id, allow, deny
+		FROM channel_overwrites
+		WHERE channel_id = ?`, channelID)
+	return overwrites, err
+}
+
+// AllOverwrites returns the overwrites of every channel
+func AllOverwrites(q sqlx.Queryer) (map[int64][]Overwrite, error) {
+	var overwrites []Overwrite
+	err := sqlx.Select(q, &overwrites, "SELECT channel_id, target_type, target_id, allow, deny FROM channel_overwrites")
+	if err != nil {
+		return nil, err
+	}
+	byChannel := map[int64][]Overwrite{}
+	for _, o := range overwrites {
+		byChannel[o.ChannelID] = append(byChannel[o.ChannelID], o)
+	}
+	return byChannel, nil
+}
@@ -0,0 +1,92 @@
+package presence
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+NOTE : Who is online
+
+Presence lives in memory only, it changes every few seconds and means
+nothing after a restart (everyone is offline until their next heartbeat).
+
+Clients send a heartbeat every HEARTBEAT_INTERVAL with the status they want.
+A user stays in that status until HEARTBEAT_INTERVAL + GRACE after the last
+heartbeat, so one late or lost heartbeat does not flap them offline.
+Invisible users are shown as offline to everyone but themselves.
+*/
+
+const (
+	HEARTBEAT_INTERVAL = 30 * time.Second
+	GRACE              = 30 * time.Second
+)
+
+const (
+	ONLINE    = "online"
+	IDLE      = "idle"
+	DND       = "dnd"
+	INVISIBLE = "invisible"
+	OFFLINE   = "offline"
+)
+
+// Statuses a client can ask for
+var STATUSES = []string{ONLINE, IDLE, DND, INVISIBLE}
+
+type entry struct {
+	status   string
+	lastSeen time.Time
+}
+
+var (
+	mu    sync.Mutex
+	users = map[string]entry{}
+)
+
+// Heartbeat keeps username in status, an empty status keeps the current
+// one (online when there is none)
+func Heartbeat(username string, status string) string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	now := time.Now()
+	if status == "" {
+		status = ONLINE
+		if e, ok := users[username]; ok && !expired(e, now) {
+			status = e.status
+		}
+	}
+	users[username] = entry{status: status, lastSeen: now}
+
+	// Drop the ones that timed out, the map would only grow otherwise
+	for name, e := range users {
+		if expired(e, now) {
+			delete(users, name)
+		}
+	}
+	return status
+}
+
+// Get returns the status of username as they see it themselves
+func Get(username string) string {
+	mu.Lock()
+	defer mu.Unlock()
+	e, ok := users[username]
+	if !ok || expired(e, time.Now()) {
+		return OFFLINE
+	}
+	return e.status
+}
+
+// Visible returns the status of username as everyone else sees it
+func Visible(username string) string {
+	status := Get(username)
+	if status == INVISIBLE {
+		return OFFLINE
+	}
+	return status
+}
+
+func expired(e entry, now time.Time) bool {
+	return now.Sub(e.lastSeen) > HEARTBEAT_INTERVAL+GRACE
+}
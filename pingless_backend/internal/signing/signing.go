@@ -0,0 +1,244 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+NOTE : Ed25519 keys used to sign the access tokens
+
+Keys live in the signing_keys table. The newest key that is not retired
+signs, a rotated key is retired but still verifies tokens for
+RETIRED_KEY_GRACE so nobody is logged out by a rotation. Every token
+carries the kid of its key in the header.
+*/
+
+// Longer than the 24h access token lifetime, so every token signed before
+// a rotation expires before its key stops being accepted
+const RETIRED_KEY_GRACE = 48 * time.Hour
+
+// How long the in memory copy of the table is trusted, and how often an
+// unknown kid may trigger a reload
+const (
+	CACHE_TTL       = time.Minute
+	MISS_RELOAD_GAP = 5 * time.Second
+)
+
+var ErrNoSigningKey = errors.New("no active signing key")
+
+type key struct {
+	Kid        string       `db:"kid"`
+	PrivateKey string       `db:"private_key"`
+	CreatedAt  time.Time    `db:"created_at"`
+	RetiredAt  sql.NullTime `db:"retired_at"`
+
+	private ed25519.PrivateKey
+}
+
+func (k key) usable(now time.Time) bool {
+	return !k.RetiredAt.Valid || now.Before(k.RetiredAt.Time.Add(RETIRED_KEY_GRACE))
+}
+
+var cache struct {
+	sync.Mutex
+	keys     map[string]key
+	active   string
+	loadedAt time.Time
+}
+
+// EnsureKey creates the first signing key, it is called once at start up
+func EnsureKey(db *sqlx.DB) error {
+	var exists bool
+	if err := db.Get(&exists, "SELECT EXISTS(SELECT 1 FROM signing_keys WHERE retired_at IS NULL)"); err != nil {
+		return err
+	}
+	if !exists {
+		if _, err := Rotate(db); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rotate creates a new active key and retires the previous ones. Keys
+// retired for longer than the grace period are deleted.
+func Rotate(db *sqlx.DB) (string, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	kidBytes := make([]byte, 12)
+	if _, err := rand.Read(kidBytes); err != nil {
+		return "", err
+	}
+	kid := base64.RawURLEncoding.EncodeToString(kidBytes)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	var retired []key
+	if err := tx.Select(&retired, "SELECT kid, retired_at FROM signing_keys WHERE retired_at IS NOT NULL"); err != nil {
+		return "", err
+	}
+	for _, k := range retired {
+		if !k.usable(now) {
+			if _, err := tx.Exec("DELETE FROM signing_keys WHERE kid = ?", k.Kid); err != nil {
+				return "", err
+			}
+		}
+	}
+	if _, err := tx.Exec("UPDATE signing_keys SET retired_at = ? WHERE retired_at IS NULL", now); err != nil {
+		return "", err
+	}
+	_, err = tx.Exec("INSERT INTO signing_keys (kid, private_key, created_at) VALUES (?, ?, ?)",
+		kid, base64.StdEncoding.EncodeToString(private.Seed()), now)
+	if err != nil {
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	cache.Lock()
+	defer cache.Unlock()
+	return kid, reload(db)
+}
+
+// reload reads the table again, cache must be locked
+func reload(db *sqlx.DB) error {
+	var rows []key
+	if err := db.Select(&rows, "SELECT kid, private_key, created_at, retired_at FROM signing_keys ORDER BY created_at"); err != nil {
+		return err
+	}
+	keys := map[string]key{}
+	active := ""
+	for _, k := range rows {
+		seed, err := base64.StdEncoding.DecodeString(k.PrivateKey)
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return fmt.Errorf("corrupt signing key %s", k.Kid)
+		}
+		k.private = ed25519.NewKeyFromSeed(seed)
+		keys[k.Kid] = k
+		if !k.RetiredAt.Valid {
+			active = k.Kid
+		}
+	}
+	cache.keys = keys
+	cache.active = active
+	cache.loadedAt = time.Now()
+	return nil
+}
+
+func lookup(db *sqlx.DB, kid string) (key, bool, error) {
+	cache.Lock()
+	defer cache.Unlock()
+	since := time.Since(cache.loadedAt)
+	if k, ok := cache.keys[kid]; ok && since < CACHE_TTL {
+		return k, true, nil
+	}
+	if _, ok := cache.keys[kid]; ok || since > MISS_RELOAD_GAP {
+		if err := reload(db); err != nil {
+			return key{}, false, err
+		}
+	}
+	k, ok := cache.keys[kid]
+	return k, ok, nil
+}
+
+// Sign signs claims with the active key
+func Sign(db *sqlx.DB, claims jwt.Claims) (string, error) {
+	cache.Lock()
+	if cache.active == "" || time.Since(cache.loadedAt) > CACHE_TTL {
+		if err := reload(db); err != nil {
+			cache.Unlock()
+			return "", err
+		}
+	}
+	active, ok := cache.keys[cache.active]
+	cache.Unlock()
+	if !ok {
+		return "", ErrNoSigningKey
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = active.Kid
+	return token.SignedString(active.private)
+}
+
+// Parse verifies a token signed by Sign
+func Parse(db *sqlx.DB, tokenString string, options ...jwt.ParserOption) (*jwt.Token, error) {
+	options = append(options, jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg()}))
+	return jwt.Parse(tokenString, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			return nil, errors.New("token without kid")
+		}
+		k, ok, err := lookup(db, kid)
+		if err != nil {
+			return nil, err
+		}
+		if !ok || !k.usable(time.Now()) {
+			return nil, fmt.Errorf("unknown or expired signing key %q", kid)
+		}
+		return k.private.Public(), nil
+	}, options...)
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+}
+
+// PublicKeys returns every key tokens may currently be signed with
+func PublicKeys(db *sqlx.DB) ([]JWK, error) {
+	cache.Lock()
+	defer cache.Unlock()
+	if time.Since(cache.loadedAt) > CACHE_TTL {
+		if err := reload(db); err != nil {
+			return nil, err
+		}
+	}
+	usable := []key{}
+	now := time.Now()
+	for _, k := range cache.keys {
+		if k.usable(now) {
+			usable = append(usable, k)
+		}
+	}
+	// Newest first, the active key leads
+	sort.Slice(usable, func(i, j int) bool {
+		return usable[i].CreatedAt.After(usable[j].CreatedAt)
+	})
+
+	keys := []JWK{}
+	for _, k := range usable {
+		keys = append(keys, JWK{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(k.private.Public().(ed25519.PublicKey)),
+			Kid: k.Kid,
+			Use: "sig",
+			Alg: jwt.SigningMethodEdDSA.Alg(),
+		})
+	}
+	return keys, nil
+}
@@ -0,0 +1,70 @@
+package snowflake
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+NOTE : Time sortable 63 bit ids
+
+	| 41 bits ms since EPOCH | 10 bits node | 12 bits sequence |
+
+Ids made later are always bigger, so ordering by id is ordering by time and
+an id can be used as a cursor. 4096 ids per millisecond, past that the
+generator waits for the next millisecond.
+*/
+
+// 2025-01-01T00:00:00Z
+const EPOCH int64 = 1735689600000
+
+const (
+	nodeBits     = 10
+	sequenceBits = 12
+	maxSequence  = 1<<sequenceBits - 1
+)
+
+// Node is always 0, a single pingless instance owns its database
+const node int64 = 0
+
+var (
+	mu       sync.Mutex
+	lastMs   int64
+	sequence int64
+)
+
+func Next() int64 {
+	mu.Lock()
+	defer mu.Unlock()
+
+	now := time.Now().UnixMilli()
+	// A clock going backwards must not produce a smaller id
+	if now < lastMs {
+		now = lastMs
+	}
+	if now == lastMs {
+		sequence = (sequence + 1) & maxSequence
+		if sequence == 0 {
+			for now <= lastMs {
+				time.Sleep(100 * time.Microsecond)
+				now = time.Now().UnixMilli()
+			}
+		}
+	} else {
+		sequence = 0
+	}
+	lastMs = now
+
+	return (now-EPOCH)<<(nodeBits+sequenceBits) | node<<sequenceBits | sequence
+}
+
+// Time returns when id was made
+func Time(id int64) time.Time {
+	return time.UnixMilli(id>>(nodeBits+sequenceBits) + EPOCH)
+}
+
+// FromTime returns the smallest id that could be made at t, useful as a
+// cursor for "messages since t"
+func FromTime(t time.Time) int64 {
+	return (t.UnixMilli() - EPOCH) << (nodeBits + sequenceBits)
+}
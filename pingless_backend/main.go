@@ -4,7 +4,10 @@ import (
 	"log"
 	"pingless/config"
 	"pingless/db"
+	"pingless/internal/events"
+	"pingless/internal/signing"
 	"pingless/routes"
+	"pingless/routes/user"
 )
 
 func main() {
@@ -14,8 +17,17 @@ func main() {
 	}
 	log.Println(db)
 	log.Println("DB SETUP SUCCESSFUL")
+	if err := signing.EnsureKey(db); err != nil {
+		log.Fatalln(err)
+	}
+	if err := events.Init(db); err != nil {
+		log.Fatalln(err)
+	}
 	config := config.LoadConfig(db)
 	log.Println(config)
+	if err := user.SetTrustedProxies(config.TrustedProxies); err != nil {
+		log.Fatalln(err)
+	}
 
 	routes.Routes(db)
 }
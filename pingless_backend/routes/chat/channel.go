@@ -0,0 +1,817 @@
+package chat
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"pingless/internal/auditlog"
+	"pingless/internal/events"
+	"pingless/internal/permissions"
+	"pingless/internal/snowflake"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+NOTE : This file deal with text channels and the categories grouping them
+
+Channels without a category come first, then every category with its
+channels, each ordered by position. Every change is written to audit_log.
+*/
+
+const (
+	MAX_CHANNEL_NAME_SIZE  = 100
+	MAX_CATEGORY_NAME_SIZE = 100
+	MAX_CHANNELS           = 500
+	MAX_CATEGORIES         = 50
+)
+
+var errUnknownID = errors.New("unknown id")
+
+func validName(name string, max int) (string, bool) {
+	name = strings.TrimSpace(name)
+	size := utf8.RuneCountInString(name)
+	return name, size > 0 && size <= max
+}
+
+func CreateCategory(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var category CreateCategoryModel
+	if err := json.NewDecoder(r.Body).Decode(&category); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	name, ok := validName(category.Name, MAX_CATEGORY_NAME_SIZE)
+	if !ok {
+		http.Error(w, "Name must be 1 to 100 characters", http.StatusBadRequest)
+		return
+	}
+
+	var count, position int
+	if err := db.QueryRow("SELECT COUNT(*), COALESCE(MAX(position) + 1, 0) FROM categories").Scan(&count, &position); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if count >= MAX_CATEGORIES {
+		http.Error(w, "Too many categories", http.StatusBadRequest)
+		return
+	}
+
+	id := snowflake.Next()
+	_, err := db.Exec("INSERT INTO categories (id, name, position, created_at) VALUES (?, ?, ?, ?)", id, name, position, time.Now())
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	publishChannels(db)
+	auditlog.Record(db, auditlog.AuditLog{
+		UserName: username,
+		Action:   "create_category",
+		Target:   "category",
+		Metadata: map[string]string{
+			"id":   strconv.FormatInt(id, 10),
+			"name": name,
+		},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CategoryResponse{ID: id, Name: name, Position: position, Channels: []ChannelResponse{}})
+}
+
+func RenameCategory(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	rename(w, r, db, "categories", "category", MAX_CATEGORY_NAME_SIZE)
+}
+
+func RenameChannel(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	rename(w, r, db, "channels", "channel", MAX_CHANNEL_NAME_SIZE)
+}
+
+// rename is shared by channels and categories, table is a literal
+func rename(w http.ResponseWriter, r *http.Request, db *sqlx.DB, table string, target string, max int) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var rename RenameModel
+	if err := json.NewDecoder(r.Body).Decode(&rename); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	name, ok := validName(rename.Name, max)
+	if !ok {
+		http.Error(w, "Name must be 1 to 100 characters", http.StatusBadRequest)
+		return
+	}
+
+	var old string
+	if err := db.Get(&old, "SELECT name FROM "+table+" WHERE id = ?", rename.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if _, err := db.Exec("UPDATE "+table+" SET name = ? WHERE id = ?", name, rename.ID); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	publishChannels(db)
+	auditlog.Record(db, auditlog.AuditLog{
+		UserName: username,
+		Action:   "rename_" + target,
+		Target:   target,
+		Metadata: map[string]string{
+			"id":  strconv.FormatInt(rename.ID, 10),
+			"old": old,
+			"new": name,
+		},
+	})
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("Renamed\n"))
+}
+
+// DeleteCategory keeps the channels, they move to the end of the
+// channels without category
+func DeleteCategory(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var del DeleteModel
+	if err := json.NewDecoder(r.Body).Decode(&del); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var name string
+	if err := tx.Get(&name, "SELECT name FROM categories WHERE id = ?", del.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Category not found", http.StatusNotFound)
+			return
+		}
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	var channels []int64
+	if err := tx.Select(&channels, "SELECT id FROM channels WHERE category_id = ? ORDER BY position, id", del.ID); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if err := placeChannels(tx, nil, channels); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM categories WHERE id = ?", del.ID); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	publishChannels(db)
+	auditlog.Record(db, auditlog.AuditLog{
+		UserName: username,
+		Action:   "delete_category",
+		Target:   "category",
+		Metadata: map[string]string{
+			"id":   strconv.FormatInt(del.ID, 10),
+			"name": name,
+		},
+	})
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("Category Deleted\n"))
+}
+
+func ReorderCategories(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var reorder ReorderCategoriesModel
+	if err := json.NewDecoder(r.Body).Decode(&reorder); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	ids, err := parseIDs(reorder.CategoryIDs)
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var current []int64
+	if err := tx.Select(&current, "SELECT id FROM categories ORDER BY position, id"); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	order, err := mergeOrder(ids, current)
+	if err != nil {
+		http.Error(w, "Unknown category", http.StatusBadRequest)
+		return
+	}
+	for position, id := range order {
+		if _, err := tx.Exec("UPDATE categories SET position = ? WHERE id = ?", position, id); err != nil {
+			log.Println(err)
+			http.Error(w, "DB ERROR", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	publishChannels(db)
+	auditlog.Record(db, auditlog.AuditLog{
+		UserName: username,
+		Action:   "reorder_categories",
+		Target:   "category",
+		Metadata: map[string]string{
+			"order": joinIDs(order),
+		},
+	})
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("Categories Reordered\n"))
+}
+
+func CreateChannel(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var channel CreateChannelModel
+	if err := json.NewDecoder(r.Body).Decode(&channel); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	name, ok := validName(channel.Name, MAX_CHANNEL_NAME_SIZE)
+	if !ok {
+		http.Error(w, "Name must be 1 to 100 characters", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var count int
+	if err := tx.Get(&count, "SELECT COUNT(*) FROM channels"); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if count >= MAX_CHANNELS {
+		http.Error(w, "Too many channels", http.StatusBadRequest)
+		return
+	}
+	if channel.CategoryID != nil {
+		var exists bool
+		if err := tx.Get(&exists, "SELECT EXISTS(SELECT 1 FROM categories WHERE id = ?)", *channel.CategoryID); err != nil {
+			log.Println(err)
+			http.Error(w, "DB ERROR", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Category not found", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var position int
+	err = tx.Get(&position, "SELECT COALESCE(MAX(position) + 1, 0) FROM channels WHERE category_id IS ?", channel.CategoryID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	id := snowflake.Next()
+	_, err = tx.Exec("INSERT INTO channels (id, category_id, name, position, created_at) VALUES (?, ?, ?, ?, ?)",
+		id, channel.CategoryID, name, position, time.Now())
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	metadata := map[string]string{
+		"id":   strconv.FormatInt(id, 10),
+		"name": name,
+	}
+	if channel.CategoryID != nil {
+		metadata["category_id"] = strconv.FormatInt(*channel.CategoryID, 10)
+	}
+	publishChannels(db)
+	auditlog.Record(db, auditlog.AuditLog{
+		UserName: username,
+		Action:   "create_channel",
+		Target:   "channel",
+		Metadata: metadata,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ChannelResponse{ID: id, CategoryID: channel.CategoryID, Name: name, Position: position})
+}
+
+// ReorderChannels moves the listed channels into a category in that order,
+// channels already there but not listed keep their order after them
+func ReorderChannels(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var reorder ReorderChannelsModel
+	if err := json.NewDecoder(r.Body).Decode(&reorder); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	ids, err := parseIDs(reorder.ChannelIDs)
+	if err != nil || len(ids) == 0 {
+		http.Error(w, "Invalid channel_ids", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if reorder.CategoryID != nil {
+		var exists bool
+		if err := tx.Get(&exists, "SELECT EXISTS(SELECT 1 FROM categories WHERE id = ?)", *reorder.CategoryID); err != nil {
+			log.Println(err)
+			http.Error(w, "DB ERROR", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Category not found", http.StatusBadRequest)
+			return
+		}
+	}
+	for _, id := range ids {
+		var exists bool
+		if err := tx.Get(&exists, "SELECT EXISTS(SELECT 1 FROM channels WHERE id = ?)", id); err != nil {
+			log.Println(err)
+			http.Error(w, "DB ERROR", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Unknown channel", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var current []int64
+	err = tx.Select(&current, "SELECT id FROM channels WHERE category_id IS ? ORDER BY position, id", reorder.CategoryID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	// Listed channels coming from another category are not in current,
+	// add them so mergeOrder accepts them
+	for _, id := range ids {
+		if !slices.Contains(current, id) {
+			current = append(current, id)
+		}
+	}
+	order, err := mergeOrder(ids, current)
+	if err != nil {
+		http.Error(w, "Unknown channel", http.StatusBadRequest)
+		return
+	}
+	if err := setChannelOrder(tx, reorder.CategoryID, order); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	metadata := map[string]string{
+		"order": joinIDs(order),
+	}
+	if reorder.CategoryID != nil {
+		metadata["category_id"] = strconv.FormatInt(*reorder.CategoryID, 10)
+	}
+	publishChannels(db)
+	auditlog.Record(db, auditlog.AuditLog{
+		UserName: username,
+		Action:   "reorder_channels",
+		Target:   "channel",
+		Metadata: metadata,
+	})
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("Channels Reordered\n"))
+}
+
+// DeleteChannel deletes the channel with all of its messages
+func DeleteChannel(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var del DeleteModel
+	if err := json.NewDecoder(r.Body).Decode(&del); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var name string
+	if err := tx.Get(&name, "SELECT name FROM channels WHERE id = ?", del.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Channel not found", http.StatusNotFound)
+			return
+		}
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	// sqlite does not enforce the foreign keys here, messages and
+	// overwrites go by hand
+	res, err := tx.Exec("DELETE FROM messages WHERE channel_id = ?", del.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	messages, _ := res.RowsAffected()
+	if _, err := tx.Exec("DELETE FROM channel_overwrites WHERE channel_id = ?", del.ID); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM channels WHERE id = ?", del.ID); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	publishChannels(db)
+	auditlog.Record(db, auditlog.AuditLog{
+		UserName: username,
+		Action:   "delete_channel",
+		Target:   "channel",
+		Metadata: map[string]string{
+			"id":       strconv.FormatInt(del.ID, 10),
+			"name":     name,
+			"messages": strconv.FormatInt(messages, 10),
+		},
+	})
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("Channel Deleted\n"))
+}
+
+// ListChannels only lists the channels the user can view
+func ListChannels(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	list, err := channelList(db)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	visible, err := visibleChannels(db, list, username)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(visible)
+}
+
+func channelList(db *sqlx.DB) (ChannelListResponse, error) {
+	categories := []CategoryResponse{}
+	if err := db.Select(&categories, "SELECT id, name, position FROM categories ORDER BY position, id"); err != nil {
+		return ChannelListResponse{}, err
+	}
+	var channels []ChannelResponse
+	if err := db.Select(&channels, "SELECT id, category_id, name, position FROM channels ORDER BY position, id"); err != nil {
+		return ChannelListResponse{}, err
+	}
+
+	list := ChannelListResponse{Channels: []ChannelResponse{}, Categories: categories}
+	byID := map[int64]int{}
+	for i := range list.Categories {
+		list.Categories[i].Channels = []ChannelResponse{}
+		byID[list.Categories[i].ID] = i
+	}
+	for _, channel := range channels {
+		if channel.CategoryID != nil {
+			if i, ok := byID[*channel.CategoryID]; ok {
+				list.Categories[i].Channels = append(list.Categories[i].Channels, channel)
+				continue
+			}
+		}
+		list.Channels = append(list.Channels, channel)
+	}
+	return list, nil
+}
+
+// publishChannels sends the whole channel list, a change to one channel or
+// category often moves others. Everybody gets the channels they can view,
+// users seeing the same channels share one event.
+func publishChannels(db *sqlx.DB) {
+	list, err := channelList(db)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	members, err := permissions.Members(db)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	overwrites, err := permissions.AllOverwrites(db)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	type group struct {
+		list      ChannelListResponse
+		usernames []string
+	}
+	groups := map[string]*group{}
+	keys := []string{}
+	for _, member := range members {
+		visible := filterChannels(list, func(id int64) bool {
+			return permissions.Has(permissions.Compute(member, overwrites[id]), permissions.VIEW_CHANNEL)
+		})
+		key := channelKey(visible)
+		if groups[key] == nil {
+			groups[key] = &group{list: visible}
+			keys = append(keys, key)
+		}
+		groups[key].usernames = append(groups[key].usernames, member.Username)
+	}
+	// Everybody sees everything, new users included
+	if len(keys) == 1 && keys[0] == channelKey(list) {
+		events.Publish(db, events.CHANNELS_UPDATE, list)
+		return
+	}
+	for _, key := range keys {
+		events.PublishTo(db, groups[key].usernames, events.CHANNELS_UPDATE, groups[key].list)
+	}
+}
+
+// visibleChannels is list without the channels username cannot view
+func visibleChannels(db *sqlx.DB, list ChannelListResponse, username string) (ChannelListResponse, error) {
+	members, err := permissions.Members(db)
+	if err != nil {
+		return ChannelListResponse{}, err
+	}
+	overwrites, err := permissions.AllOverwrites(db)
+	if err != nil {
+		return ChannelListResponse{}, err
+	}
+	for _, member := range members {
+		if member.Username == username {
+			return filterChannels(list, func(id int64) bool {
+				return permissions.Has(permissions.Compute(member, overwrites[id]), permissions.VIEW_CHANNEL)
+			}), nil
+		}
+	}
+	return ChannelListResponse{Channels: []ChannelResponse{}, Categories: []CategoryResponse{}}, nil
+}
+
+// filterChannels keeps the channels for which keep is true, categories stay
+func filterChannels(list ChannelListResponse, keep func(id int64) bool) ChannelListResponse {
+	keepChannels := func(channels []ChannelResponse) []ChannelResponse {
+		kept := []ChannelResponse{}
+		for _, channel := range channels {
+			if keep(channel.ID) {
+				kept = append(kept, channel)
+			}
+		}
+		return kept
+	}
+	filtered := ChannelListResponse{Channels: keepChannels(list.Channels), Categories: []CategoryResponse{}}
+	for _, category := range list.Categories {
+		category.Channels = keepChannels(category.Channels)
+		filtered.Categories = append(filtered.Categories, category)
+	}
+	return filtered
+}
+
+// channelKey identifies the channels of a list
+func channelKey(list ChannelListResponse) string {
+	ids := []int64{}
+	for _, channel := range list.Channels {
+		ids = append(ids, channel.ID)
+	}
+	for _, category := range list.Categories {
+		for _, channel := range category.Channels {
+			ids = append(ids, channel.ID)
+		}
+	}
+	return joinIDs(ids)
+}
+
+// placeChannels appends channels at the end of category
+func placeChannels(tx *sqlx.Tx, categoryID *int64, channels []int64) error {
+	var current []int64
+	if err := tx.Select(&current, "SELECT id FROM channels WHERE category_id IS ? ORDER BY position, id", categoryID); err != nil {
+		return err
+	}
+	return setChannelOrder(tx, categoryID, append(current, channels...))
+}
+
+func setChannelOrder(tx *sqlx.Tx, categoryID *int64, order []int64) error {
+	for position, id := range order {
+		if _, err := tx.Exec("UPDATE channels SET category_id = ?, position = ? WHERE id = ?", categoryID, position, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeOrder puts ids first and the rest of current after them. Every id
+// has to be in current.
+func mergeOrder(ids []int64, current []int64) ([]int64, error) {
+	order := make([]int64, 0, len(current))
+	seen := map[int64]bool{}
+	for _, id := range ids {
+		if !slices.Contains(current, id) {
+			return nil, errUnknownID
+		}
+		if !seen[id] {
+			seen[id] = true
+			order = append(order, id)
+		}
+	}
+	for _, id := range current {
+		if !seen[id] {
+			order = append(order, id)
+		}
+	}
+	return order, nil
+}
+
+func parseIDs(raw []string) ([]int64, error) {
+	ids := make([]int64, 0, len(raw))
+	for _, s := range raw {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func joinIDs(ids []int64) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.FormatInt(id, 10)
+	}
+	return strings.Join(parts, ",")
+}
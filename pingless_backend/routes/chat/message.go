@@ -0,0 +1,381 @@
+package chat
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"pingless/internal/auditlog"
+	"pingless/internal/events"
+	"pingless/internal/permissions"
+	"pingless/internal/snowflake"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+NOTE : This file deal with channel messages
+
+Message ids are snowflakes so history is paged with the id of a message as
+cursor: before (older), after (newer) or around (both sides). History is
+always returned oldest first.
+*/
+
+const (
+	MAX_MESSAGE_SIZE      = 2000
+	DEFAULT_HISTORY_LIMIT = 50
+	MAX_HISTORY_LIMIT     = 100
+)
+
+const messageSelect = `
+	SELECT m.id, m.channel_id, u.username AS author, m.content, m.edited_at, m.created_at
+	FROM messages m
+	JOIN users u ON m.author_id = u.id`
+
+func validContent(content string) (string, bool) {
+	content = strings.TrimSpace(content)
+	size := utf8.RuneCountInString(content)
+	return content, size > 0 && size <= MAX_MESSAGE_SIZE
+}
+
+func SendMessage(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var message SendMessageModel
+	if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	content, ok := validContent(message.Content)
+	if !ok {
+		http.Error(w, "Message must be 1 to 2000 characters", http.StatusBadRequest)
+		return
+	}
+
+	if !channelAccess(w, db, username, message.ChannelID, permissions.VIEW_CHANNEL|permissions.SEND_MESSAGES) {
+		return
+	}
+
+	id := snowflake.Next()
+	now := time.Now()
+	_, err := db.Exec(`
+		INSERT INTO messages (id, channel_id, author_id, content, created_at)
+		SELECT ?, ?, id, ?, ? FROM users WHERE username = ?`,
+		id, message.ChannelID, content, now, username)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	created := MessageResponse{
+		ID:        id,
+		ChannelID: message.ChannelID,
+		Author:    username,
+		Content:   content,
+		CreatedAt: now,
+	}
+	publishMessage(db, message.ChannelID, events.MESSAGE_CREATE, created)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+// EditMessage is only allowed to the author, while they can still send in
+// the channel
+func EditMessage(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var edit EditMessageModel
+	if err := json.NewDecoder(r.Body).Decode(&edit); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	content, ok := validContent(edit.Content)
+	if !ok {
+		http.Error(w, "Message must be 1 to 2000 characters", http.StatusBadRequest)
+		return
+	}
+
+	message, err := getMessage(db, edit.ID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Message not found", http.StatusNotFound)
+			return
+		}
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if !channelAccess(w, db, username, message.ChannelID, permissions.VIEW_CHANNEL|permissions.SEND_MESSAGES) {
+		return
+	}
+	if message.Author != username {
+		http.Error(w, "Only the author can edit a message", http.StatusForbidden)
+		return
+	}
+
+	now := time.Now()
+	if _, err := db.Exec("UPDATE messages SET content = ?, edited_at = ? WHERE id = ?", content, now, edit.ID); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	message.Content = content
+	message.EditedAt = &now
+	publishMessage(db, message.ChannelID, events.MESSAGE_UPDATE, message)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(message)
+}
+
+// DeleteMessage is allowed to the author and to those who can manage
+// messages in the channel, both must still view it. A moderated delete is
+// written to audit_log
+func DeleteMessage(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var del DeleteModel
+	if err := json.NewDecoder(r.Body).Decode(&del); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	message, err := getMessage(db, del.ID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Message not found", http.StatusNotFound)
+			return
+		}
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	moderated := message.Author != username
+	want := permissions.VIEW_CHANNEL
+	if moderated {
+		want |= permissions.MANAGE_MESSAGES
+	}
+	if !channelAccess(w, db, username, message.ChannelID, want) {
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM messages WHERE id = ?", del.ID); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	publishMessage(db, message.ChannelID, events.MESSAGE_DELETE, events.MessageDelete{ID: del.ID, ChannelID: message.ChannelID})
+
+	if moderated {
+		auditlog.Record(db, auditlog.AuditLog{
+			UserName: username,
+			Action:   "delete_message",
+			Target:   "message",
+			Metadata: map[string]string{
+				"id":         strconv.FormatInt(del.ID, 10),
+				"channel_id": strconv.FormatInt(message.ChannelID, 10),
+				"author":     message.Author,
+			},
+		})
+	}
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("Message Deleted\n"))
+}
+
+// MessageHistory takes channel_id, limit and at most one of before, after
+// and around. Without cursor the latest messages are returned.
+func MessageHistory(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	channelID, err := strconv.ParseInt(query.Get("channel_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid channel_id", http.StatusBadRequest)
+		return
+	}
+
+	limit := DEFAULT_HISTORY_LIMIT
+	if raw := query.Get("limit"); raw != "" {
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > MAX_HISTORY_LIMIT {
+			http.Error(w, "Allowed limit 1 ≤ limit ≤ 100", http.StatusBadRequest)
+			return
+		}
+	}
+
+	cursorName, cursor := "", int64(0)
+	for _, name := range []string{"before", "after", "around"} {
+		raw := query.Get(name)
+		if raw == "" {
+			continue
+		}
+		if cursorName != "" {
+			http.Error(w, "Use only one of before, after and around", http.StatusBadRequest)
+			return
+		}
+		cursor, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid "+name, http.StatusBadRequest)
+			return
+		}
+		cursorName = name
+	}
+
+	if !channelAccess(w, db, username, channelID, permissions.VIEW_CHANNEL) {
+		return
+	}
+
+	var messages []MessageResponse
+	switch cursorName {
+	case "after":
+		messages, err = newerMessages(db, channelID, cursor, false, limit)
+	case "around":
+		// Half older than the cursor, the rest (with the cursor itself) newer
+		var older []MessageResponse
+		older, err = olderMessages(db, channelID, cursor, limit/2)
+		if err == nil {
+			messages, err = newerMessages(db, channelID, cursor, true, limit-len(older))
+			messages = append(older, messages...)
+		}
+	case "before":
+		messages, err = olderMessages(db, channelID, cursor, limit)
+	default:
+		messages, err = olderMessages(db, channelID, snowflake.FromTime(time.Now().Add(time.Minute)), limit)
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+// olderMessages returns up to limit messages before id, oldest first
+func olderMessages(db *sqlx.DB, channelID int64, id int64, limit int) ([]MessageResponse, error) {
+	messages := []MessageResponse{}
+	if limit == 0 {
+		return messages, nil
+	}
+	err := db.Select(&messages, messageSelect+`
+		WHERE m.channel_id = ? AND m.id < ?
+		ORDER BY m.id DESC
+		LIMIT ?`, channelID, id, limit)
+	slices.Reverse(messages)
+	return messages, err
+}
+
+// newerMessages returns up to limit messages after id, oldest first
+func newerMessages(db *sqlx.DB, channelID int64, id int64, inclusive bool, limit int) ([]MessageResponse, error) {
+	messages := []MessageResponse{}
+	op := ">"
+	if inclusive {
+		op = ">="
+	}
+	err := db.Select(&messages, messageSelect+`
+		WHERE m.channel_id = ? AND m.id `+op+` ?
+		ORDER BY m.id ASC
+		LIMIT ?`, channelID, id, limit)
+	return messages, err
+}
+
+// channelAccess fails unless the channel exists and username has want in
+// it, channels one cannot view are not found
+func channelAccess(w http.ResponseWriter, db *sqlx.DB, username string, channelID int64, want int64) bool {
+	var exists bool
+	if err := db.Get(&exists, "SELECT EXISTS(SELECT 1 FROM channels WHERE id = ?)", channelID); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return false
+	}
+	perms, err := permissions.Resolve(db, username, channelID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return false
+	}
+	if !exists || !permissions.Has(perms, permissions.VIEW_CHANNEL) {
+		http.Error(w, "Channel not found", http.StatusNotFound)
+		return false
+	}
+	if !permissions.Has(perms, want) {
+		http.Error(w, "Missing permission in this channel", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// publishMessage sends a message event to those who can view the channel
+func publishMessage(db *sqlx.DB, channelID int64, eventType string, data any) {
+	audience, err := permissions.Audience(db, channelID, permissions.VIEW_CHANNEL)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if audience == nil {
+		events.Publish(db, eventType, data)
+		return
+	}
+	events.PublishTo(db, audience, eventType, data)
+}
+
+func getMessage(db *sqlx.DB, id int64) (MessageResponse, error) {
+	var message MessageResponse
+	err := db.Get(&message, messageSelect+" WHERE m.id = ?", id)
+	return message, err
+}
@@ -0,0 +1,95 @@
+package chat
+
+import "time"
+
+// Snowflake ids are sent as strings, they do not fit in a javascript number
+
+type CreateCategoryModel struct {
+	Name string `json:"name"`
+}
+
+type RenameModel struct {
+	ID   int64  `json:"id,string"`
+	Name string `json:"name"`
+}
+
+type DeleteModel struct {
+	ID int64 `json:"id,string"`
+}
+
+type ReorderCategoriesModel struct {
+	CategoryIDs []string `json:"category_ids"`
+}
+
+type CreateChannelModel struct {
+	Name       string `json:"name"`
+	CategoryID *int64 `json:"category_id,string"`
+}
+
+// Channels listed move to the category (null = no category) in that order
+type ReorderChannelsModel struct {
+	CategoryID *int64   `json:"category_id,string"`
+	ChannelIDs []string `json:"channel_ids"`
+}
+
+type SendMessageModel struct {
+	ChannelID int64  `json:"channel_id,string"`
+	Content   string `json:"content"`
+}
+
+type EditMessageModel struct {
+	ID      int64  `json:"id,string"`
+	Content string `json:"content"`
+}
+
+type CategoryResponse struct {
+	ID       int64             `json:"id,string" db:"id"`
+	Name     string            `json:"name" db:"name"`
+	Position int               `json:"position" db:"position"`
+	Channels []ChannelResponse `json:"channels" db:"-"`
+}
+
+type ChannelResponse struct {
+	ID         int64  `json:"id,string" db:"id"`
+	CategoryID *int64 `json:"category_id,string" db:"category_id"`
+	Name       string `json:"name" db:"name"`
+	Position   int    `json:"position" db:"position"`
+}
+
+type ChannelListResponse struct {
+	Channels   []ChannelResponse  `json:"channels"`
+	Categories []CategoryResponse `json:"categories"`
+}
+
+type MessageResponse struct {
+	ID        int64      `json:"id,string" db:"id"`
+	ChannelID int64      `json:"channel_id,string" db:"channel_id"`
+	Author    string     `json:"author" db:"author"`
+	Content   string     `json:"content" db:"content"`
+	EditedAt  *time.Time `json:"edited_at" db:"edited_at"`
+	CreatedAt time.Time  `json:"created_at" db:"created_at"`
+}
+
+// One of role_id and username, allow and deny are permission bitfields
+type SetOverwriteModel struct {
+	ChannelID int64   `json:"channel_id,string"`
+	RoleID    *int    `json:"role_id"`
+	Username  *string `json:"username"`
+	Allow     int64   `json:"allow,string"`
+	Deny      int64   `json:"deny,string"`
+}
+
+type DeleteOverwriteModel struct {
+	ChannelID int64   `json:"channel_id,string"`
+	RoleID    *int    `json:"role_id"`
+	Username  *string `json:"username"`
+}
+
+type OverwriteResponse struct {
+	ChannelID  int64  `json:"channel_id,string" db:"channel_id"`
+	TargetType string `json:"target_type" db:"target_type"`
+	TargetID   int    `json:"target_id" db:"target_id"`
+	Name       string `json:"name" db:"name"` // role name or username
+	Allow      int64  `json:"allow,string" db:"allow"`
+	Deny       int64  `json:"deny,string" db:"deny"`
+}
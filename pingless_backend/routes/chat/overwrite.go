@@ -0,0 +1,273 @@
+package chat
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"pingless/internal/auditlog"
+	"pingless/internal/permissions"
+	"pingless/routes/role"
+	"strconv"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+NOTE : This file deal with the permission overwrites of channels
+
+An overwrite allows or denies channel permissions (view, send, manage
+messages) to a role or to one user in one channel, see internal/permissions
+for how they add up. Setting one replaces the previous overwrite of the same
+target. Roles have to be below the caller's and nobody can allow or deny a
+permission they do not have in the channel. Every change is written to
+audit_log and the channel list sent again since who sees what may change.
+*/
+
+var errNoTarget = errors.New("give one of role_id and username")
+
+// overwriteTarget resolves role_id or username to target_type and id
+func overwriteTarget(db *sqlx.DB, roleID *int, target *string) (string, int, string, error) {
+	if (roleID == nil) == (target == nil) {
+		return "", 0, "", errNoTarget
+	}
+	if roleID != nil {
+		var name string
+		if err := db.Get(&name, "SELECT name FROM roles WHERE id = ?", *roleID); err != nil {
+			return "", 0, "", err
+		}
+		return permissions.TARGET_ROLE, *roleID, name, nil
+	}
+	var id int
+	if err := db.Get(&id, "SELECT id FROM users WHERE username = ?", *target); err != nil {
+		return "", 0, "", err
+	}
+	return permissions.TARGET_USER, id, *target, nil
+}
+
+func overwriteError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errNoTarget):
+		http.Error(w, "Give one of role_id and username", http.StatusBadRequest)
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "Not found", http.StatusNotFound)
+	default:
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+	}
+}
+
+func SetOverwrite(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var set SetOverwriteModel
+	if err := json.NewDecoder(r.Body).Decode(&set); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if (set.Allow|set.Deny)&^permissions.CHANNEL != 0 {
+		http.Error(w, "Only view_channel, send_messages and manage_messages can be overwritten", http.StatusBadRequest)
+		return
+	}
+	if set.Allow&set.Deny != 0 {
+		http.Error(w, "A permission cannot be both allowed and denied", http.StatusBadRequest)
+		return
+	}
+
+	if !channelExists(w, db, set.ChannelID) {
+		return
+	}
+	targetType, targetID, name, err := overwriteTarget(db, set.RoleID, set.Username)
+	if err != nil {
+		overwriteError(w, err)
+		return
+	}
+	if !canOverwrite(w, db, username, set.ChannelID, targetType, targetID, set.Allow|set.Deny) {
+		return
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO channel_overwrites (channel_id, target_type, target_id, allow, deny)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (channel_id, target_type, target_id) DO UPDATE SET allow = excluded.allow, deny = excluded.deny`,
+		set.ChannelID, targetType, targetID, set.Allow, set.Deny)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	publishChannels(db)
+	auditlog.Record(db, auditlog.AuditLog{
+		UserName: username,
+		Action:   "set_overwrite",
+		Target:   "channel",
+		Metadata: map[string]string{
+			"channel_id":  strconv.FormatInt(set.ChannelID, 10),
+			"target_type": targetType,
+			"target":      name,
+			"allow":       permissions.Names(set.Allow),
+			"deny":        permissions.Names(set.Deny),
+		},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(OverwriteResponse{
+		ChannelID:  set.ChannelID,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Name:       name,
+		Allow:      set.Allow,
+		Deny:       set.Deny,
+	})
+}
+
+func DeleteOverwrite(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var del DeleteOverwriteModel
+	if err := json.NewDecoder(r.Body).Decode(&del); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	targetType, targetID, name, err := overwriteTarget(db, del.RoleID, del.Username)
+	if err != nil {
+		overwriteError(w, err)
+		return
+	}
+
+	var current permissions.Overwrite
+	err = db.Get(&current, `
+		SELECT channel_id, target_type, target_id, allow, deny FROM channel_overwrites
+		WHERE channel_id = ? AND target_type = ? AND target_id = ?`, del.ChannelID, targetType, targetID)
+	if err != nil {
+		overwriteError(w, err)
+		return
+	}
+	if !canOverwrite(w, db, username, del.ChannelID, targetType, targetID, current.Allow|current.Deny) {
+		return
+	}
+	_, err = db.Exec("DELETE FROM channel_overwrites WHERE channel_id = ? AND target_type = ? AND target_id = ?",
+		del.ChannelID, targetType, targetID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	publishChannels(db)
+	auditlog.Record(db, auditlog.AuditLog{
+		UserName: username,
+		Action:   "delete_overwrite",
+		Target:   "channel",
+		Metadata: map[string]string{
+			"channel_id":  strconv.FormatInt(del.ChannelID, 10),
+			"target_type": targetType,
+			"target":      name,
+		},
+	})
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("Overwrite Deleted\n"))
+}
+
+func ListOverwrites(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	channelID, err := strconv.ParseInt(r.URL.Query().Get("channel_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid channel_id", http.StatusBadRequest)
+		return
+	}
+	if !channelExists(w, db, channelID) {
+		return
+	}
+
+	overwrites := []OverwriteResponse{}
+	err = db.Select(&overwrites, `
+		SELECT o.channel_id, o.target_type, o.target_id, COALESCE(r.name, u.username, '') AS name, o.allow, o.deny
+		FROM channel_overwrites o
+		LEFT JOIN roles r ON o.target_type = 'role' AND o.target_id = r.id
+		LEFT JOIN users u ON o.target_type = 'user' AND o.target_id = u.id
+		WHERE o.channel_id = ?
+		ORDER BY o.target_type, o.target_id`, channelID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(overwrites)
+}
+
+func channelExists(w http.ResponseWriter, db *sqlx.DB, channelID int64) bool {
+	var exists bool
+	if err := db.Get(&exists, "SELECT EXISTS(SELECT 1 FROM channels WHERE id = ?)", channelID); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return false
+	}
+	if !exists {
+		http.Error(w, "Channel not found", http.StatusNotFound)
+	}
+	return exists
+}
+
+// canOverwrite checks the caller ranks above the target and may touch bits
+// in the channel, it writes the error
+func canOverwrite(w http.ResponseWriter, db *sqlx.DB, username string, channelID int64, targetType string, targetID int, bits int64) bool {
+	if targetType == permissions.TARGET_ROLE {
+		below, err := role.CanAssign(db, username, targetID)
+		if err != nil {
+			overwriteError(w, err)
+			return false
+		}
+		if !below {
+			http.Error(w, "You can only set overwrites for roles below yours", http.StatusForbidden)
+			return false
+		}
+	}
+	if targetType == permissions.TARGET_USER {
+		below, err := role.CanManageUser(db, username, targetID)
+		if err != nil {
+			overwriteError(w, err)
+			return false
+		}
+		if !below {
+			http.Error(w, "You can only set overwrites for users below you", http.StatusForbidden)
+			return false
+		}
+	}
+	perms, err := permissions.Resolve(db, username, channelID)
+	if err != nil {
+		overwriteError(w, err)
+		return false
+	}
+	if !permissions.Has(perms, bits) {
+		http.Error(w, "You cannot overwrite a permission you do not have", http.StatusForbidden)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,331 @@
+package dm
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"pingless/internal/events"
+	"pingless/internal/snowflake"
+	"pingless/routes/user"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+NOTE : This file deal with direct message conversations
+
+A conversation is between the requester and the users named on open. The
+one to one conversation of two users is unique and opening it again returns
+it, each open with more users makes a new group. Nobody can open a
+conversation with a user they blocked or who blocked them. Only participants can read
+or write a conversation, its events go to them only.
+
+Conversations are listed by last activity, last_activity_id is a snowflake so
+it is also the cursor.
+*/
+
+const (
+	MAX_DM_PARTICIPANTS         = 10
+	DEFAULT_CONVERSATIONS_LIMIT = 50
+	MAX_CONVERSATIONS_LIMIT     = 100
+)
+
+func OpenConversation(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var open OpenConversationModel
+	if err := json.NewDecoder(r.Body).Decode(&open); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	others := []string{}
+	for _, name := range open.Usernames {
+		name = strings.TrimSpace(name)
+		if name != "" && name != username && !slices.Contains(others, name) {
+			others = append(others, name)
+		}
+	}
+	if len(others) == 0 {
+		http.Error(w, "Name at least one other user", http.StatusBadRequest)
+		return
+	}
+	if len(others)+1 > MAX_DM_PARTICIPANTS {
+		http.Error(w, fmt.Sprintf("A conversation has at most %d participants", MAX_DM_PARTICIPANTS), http.StatusBadRequest)
+		return
+	}
+
+	names := append([]string{username}, others...)
+	query, args, err := sqlx.In("SELECT id, username FROM users WHERE username IN (?)", names)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	var users []struct {
+		ID       int    `db:"id"`
+		Username string `db:"username"`
+	}
+	if err := db.Select(&users, query, args...); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	ids := map[string]int{}
+	for _, u := range users {
+		ids[u.Username] = u.ID
+	}
+	for _, name := range others {
+		if _, ok := ids[name]; !ok {
+			http.Error(w, "User not found: "+name, http.StatusNotFound)
+			return
+		}
+	}
+
+	for _, name := range others {
+		blocked, err := user.Blocked(db, username, name)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "DB ERROR", http.StatusInternalServerError)
+			return
+		}
+		if blocked {
+			http.Error(w, "Cannot message this user", http.StatusForbidden)
+			return
+		}
+	}
+
+	var dmKey *string
+	if len(others) == 1 {
+		a, b := ids[username], ids[others[0]]
+		key := fmt.Sprintf("%d:%d", min(a, b), max(a, b))
+		dmKey = &key
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	id := snowflake.Next()
+	now := time.Now()
+	res, err := tx.Exec(`
+		INSERT INTO dm_conversations (id, dm_key, is_group, last_activity_id, created_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(dm_key) DO NOTHING`,
+		id, dmKey, dmKey == nil, id, now)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	created := true
+	if n, _ := res.RowsAffected(); n == 0 {
+		// The one to one conversation is already there
+		created = false
+		if err := tx.Get(&id, "SELECT id FROM dm_conversations WHERE dm_key = ?", *dmKey); err != nil {
+			log.Println(err)
+			http.Error(w, "DB ERROR", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		for _, name := range names {
+			_, err := tx.Exec("INSERT INTO dm_participants (conversation_id, user_id, joined_at) VALUES (?, ?, ?)", id, ids[name], now)
+			if err != nil {
+				log.Println(err)
+				http.Error(w, "DB ERROR", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	conversations, err := loadConversations(db, "c.id = ?", id)
+	if err != nil || len(conversations) == 0 {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	conversation := conversations[0]
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+		events.PublishTo(db, conversation.Participants, events.DM_CONVERSATION_CREATE, conversation)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(conversation)
+}
+
+// ListConversations takes limit and before (a last_activity_id), newest
+// activity first
+func ListConversations(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	limit := DEFAULT_CONVERSATIONS_LIMIT
+	if raw := query.Get("limit"); raw != "" {
+		var err error
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > MAX_CONVERSATIONS_LIMIT {
+			http.Error(w, "Allowed limit 1 ≤ limit ≤ 100", http.StatusBadRequest)
+			return
+		}
+	}
+	before := int64(1<<63 - 1)
+	if raw := query.Get("before"); raw != "" {
+		var err error
+		before, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid before", http.StatusBadRequest)
+			return
+		}
+	}
+
+	conversations, err := loadConversations(db, `
+		c.id IN (SELECT p.conversation_id FROM dm_participants p JOIN users u ON p.user_id = u.id WHERE u.username = ?)
+		AND c.last_activity_id < ?
+		ORDER BY c.last_activity_id DESC
+		LIMIT ?`, username, before, limit)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(conversations)
+}
+
+// loadConversations returns the conversations matching where, with their
+// participants and last message
+func loadConversations(db *sqlx.DB, where string, args ...any) ([]ConversationResponse, error) {
+	conversations := []ConversationResponse{}
+	err := db.Select(&conversations, `
+		SELECT c.id, c.is_group, c.last_message_id, c.last_activity_id
+		FROM dm_conversations c
+		WHERE `+where, args...)
+	if err != nil || len(conversations) == 0 {
+		return conversations, err
+	}
+
+	ids := []int64{}
+	messageIDs := []int64{}
+	for _, c := range conversations {
+		ids = append(ids, c.ID)
+		if c.LastMessageID != nil {
+			messageIDs = append(messageIDs, *c.LastMessageID)
+		}
+	}
+
+	query, inArgs, err := sqlx.In(`
+		SELECT p.conversation_id, u.username
+		FROM dm_participants p
+		JOIN users u ON p.user_id = u.id
+		WHERE p.conversation_id IN (?)
+		ORDER BY u.username`, ids)
+	if err != nil {
+		return nil, err
+	}
+	var participants []struct {
+		ConversationID int64  `db:"conversation_id"`
+		Username       string `db:"username"`
+	}
+	if err := db.Select(&participants, query, inArgs...); err != nil {
+		return nil, err
+	}
+	byConversation := map[int64][]string{}
+	for _, p := range participants {
+		byConversation[p.ConversationID] = append(byConversation[p.ConversationID], p.Username)
+	}
+
+	lastMessages := map[int64]MessageResponse{}
+	if len(messageIDs) > 0 {
+		query, inArgs, err := sqlx.In(messageSelect+" WHERE m.id IN (?)", messageIDs)
+		if err != nil {
+			return nil, err
+		}
+		var messages []MessageResponse
+		if err := db.Select(&messages, query, inArgs...); err != nil {
+			return nil, err
+		}
+		for _, m := range messages {
+			lastMessages[m.ConversationID] = m
+		}
+	}
+
+	for i := range conversations {
+		c := &conversations[i]
+		c.Participants = byConversation[c.ID]
+		if m, ok := lastMessages[c.ID]; ok {
+			c.LastMessage = &m
+		}
+		c.LastActivityAt = snowflake.Time(c.LastActivityID)
+	}
+	return conversations, nil
+}
+
+// participants returns the usernames in the conversation, sql.ErrNoRows when
+// username is not one of them (or there is no such conversation)
+func participants(db *sqlx.DB, conversationID int64, username string) ([]string, error) {
+	var names []string
+	err := db.Select(&names, `
+		SELECT u.username
+		FROM dm_participants p
+		JOIN users u ON p.user_id = u.id
+		WHERE p.conversation_id = ?`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(names, username) {
+		return nil, sql.ErrNoRows
+	}
+	return names, nil
+}
+
+// notParticipant answers for errors of participants
+func notParticipant(w http.ResponseWriter, err error) {
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return
+	}
+	log.Println(err)
+	http.Error(w, "DB ERROR", http.StatusInternalServerError)
+}
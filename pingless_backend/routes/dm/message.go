@@ -0,0 +1,383 @@
+package dm
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"pingless/internal/events"
+	"pingless/internal/snowflake"
+	"pingless/routes/user"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+NOTE : This file deal with direct messages
+
+Same rules as channel messages: ids are snowflakes used as history cursors
+(before, after or around), history is returned oldest first. Only the author
+can edit or delete a direct message.
+*/
+
+const (
+	MAX_MESSAGE_SIZE      = 2000
+	DEFAULT_HISTORY_LIMIT = 50
+	MAX_HISTORY_LIMIT     = 100
+)
+
+const messageSelect = `
+	SELECT m.id, m.conversation_id, u.username AS author, m.content, m.edited_at, m.created_at
+	FROM dm_messages m
+	JOIN users u ON m.author_id = u.id`
+
+func validContent(content string) (string, bool) {
+	content = strings.TrimSpace(content)
+	size := utf8.RuneCountInString(content)
+	return content, size > 0 && size <= MAX_MESSAGE_SIZE
+}
+
+func SendMessage(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var message SendMessageModel
+	if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	content, ok := validContent(message.Content)
+	if !ok {
+		http.Error(w, "Message must be 1 to 2000 characters", http.StatusBadRequest)
+		return
+	}
+
+	names, err := participants(db, message.ConversationID, username)
+	if err != nil {
+		notParticipant(w, err)
+		return
+	}
+	if len(names) == 2 {
+		// One to one conversations close with a block, groups stay open
+		other := names[0]
+		if other == username {
+			other = names[1]
+		}
+		blocked, err := user.Blocked(db, username, other)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "DB ERROR", http.StatusInternalServerError)
+			return
+		}
+		if blocked {
+			http.Error(w, "Cannot message this user", http.StatusForbidden)
+			return
+		}
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	id := snowflake.Next()
+	now := time.Now()
+	_, err = tx.Exec(`
+		INSERT INTO dm_messages (id, conversation_id, author_id, content, created_at)
+		SELECT ?, ?, id, ?, ? FROM users WHERE username = ?`,
+		id, message.ConversationID, content, now, username)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec("UPDATE dm_conversations SET last_message_id = ?, last_activity_id = ? WHERE id = ?", id, id, message.ConversationID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	created := MessageResponse{
+		ID:             id,
+		ConversationID: message.ConversationID,
+		Author:         username,
+		Content:        content,
+		CreatedAt:      now,
+	}
+	events.PublishTo(db, names, events.DM_MESSAGE_CREATE, created)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+func EditMessage(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var edit EditMessageModel
+	if err := json.NewDecoder(r.Body).Decode(&edit); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	content, ok := validContent(edit.Content)
+	if !ok {
+		http.Error(w, "Message must be 1 to 2000 characters", http.StatusBadRequest)
+		return
+	}
+
+	message, names, err := ownMessage(db, edit.ID, username)
+	if err != nil {
+		notOwnMessage(w, err)
+		return
+	}
+
+	now := time.Now()
+	if _, err := db.Exec("UPDATE dm_messages SET content = ?, edited_at = ? WHERE id = ?", content, now, edit.ID); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	message.Content = content
+	message.EditedAt = &now
+	events.PublishTo(db, names, events.DM_MESSAGE_UPDATE, message)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(message)
+}
+
+func DeleteMessage(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var del DeleteMessageModel
+	if err := json.NewDecoder(r.Body).Decode(&del); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	message, names, err := ownMessage(db, del.ID, username)
+	if err != nil {
+		notOwnMessage(w, err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM dm_messages WHERE id = ?", del.ID); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	// The conversation keeps its place in the list, only the preview changes
+	_, err = tx.Exec(`
+		UPDATE dm_conversations
+		SET last_message_id = (SELECT MAX(id) FROM dm_messages WHERE conversation_id = ?)
+		WHERE id = ?`, message.ConversationID, message.ConversationID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	events.PublishTo(db, names, events.DM_MESSAGE_DELETE, events.DmMessageDelete{ID: del.ID, ConversationID: message.ConversationID})
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("Message Deleted\n"))
+}
+
+// MessageHistory takes conversation_id, limit and at most one of before,
+// after and around. Without cursor the latest messages are returned.
+func MessageHistory(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	conversationID, err := strconv.ParseInt(query.Get("conversation_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid conversation_id", http.StatusBadRequest)
+		return
+	}
+
+	limit := DEFAULT_HISTORY_LIMIT
+	if raw := query.Get("limit"); raw != "" {
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > MAX_HISTORY_LIMIT {
+			http.Error(w, "Allowed limit 1 ≤ limit ≤ 100", http.StatusBadRequest)
+			return
+		}
+	}
+
+	cursorName, cursor := "", int64(0)
+	for _, name := range []string{"before", "after", "around"} {
+		raw := query.Get(name)
+		if raw == "" {
+			continue
+		}
+		if cursorName != "" {
+			http.Error(w, "Use only one of before, after and around", http.StatusBadRequest)
+			return
+		}
+		cursor, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid "+name, http.StatusBadRequest)
+			return
+		}
+		cursorName = name
+	}
+
+	if _, err := participants(db, conversationID, username); err != nil {
+		notParticipant(w, err)
+		return
+	}
+
+	var messages []MessageResponse
+	switch cursorName {
+	case "after":
+		messages, err = newerMessages(db, conversationID, cursor, false, limit)
+	case "around":
+		// Half older than the cursor, the rest (with the cursor itself) newer
+		var older []MessageResponse
+		older, err = olderMessages(db, conversationID, cursor, limit/2)
+		if err == nil {
+			messages, err = newerMessages(db, conversationID, cursor, true, limit-len(older))
+			messages = append(older, messages...)
+		}
+	case "before":
+		messages, err = olderMessages(db, conversationID, cursor, limit)
+	default:
+		messages, err = olderMessages(db, conversationID, snowflake.FromTime(time.Now().Add(time.Minute)), limit)
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+// olderMessages returns up to limit messages before id, oldest first
+func olderMessages(db *sqlx.DB, conversationID int64, id int64, limit int) ([]MessageResponse, error) {
+	messages := []MessageResponse{}
+	if limit == 0 {
+		return messages, nil
+	}
+	err := db.Select(&messages, messageSelect+`
+		WHERE m.conversation_id = ? AND m.id < ?
+		ORDER BY m.id DESC
+		LIMIT ?`, conversationID, id, limit)
+	slices.Reverse(messages)
+	return messages, err
+}
+
+// newerMessages returns up to limit messages after id, oldest first
+func newerMessages(db *sqlx.DB, conversationID int64, id int64, inclusive bool, limit int) ([]MessageResponse, error) {
+	messages := []MessageResponse{}
+	op := ">"
+	if inclusive {
+		op = ">="
+	}
+	err := db.Select(&messages, messageSelect+`
+		WHERE m.conversation_id = ? AND m.id `+op+` ?
+		ORDER BY m.id ASC
+		LIMIT ?`, conversationID, id, limit)
+	return messages, err
+}
+
+var errNotAuthor = errors.New("not the author")
+
+// ownMessage returns the message if username wrote it, with the participants
+// of its conversation
+func ownMessage(db *sqlx.DB, id int64, username string) (MessageResponse, []string, error) {
+	var message MessageResponse
+	if err := db.Get(&message, messageSelect+" WHERE m.id = ?", id); err != nil {
+		return message, nil, err
+	}
+	names, err := participants(db, message.ConversationID, username)
+	if err != nil {
+		return message, nil, err
+	}
+	if message.Author != username {
+		return message, nil, errNotAuthor
+	}
+	return message, names, nil
+}
+
+func notOwnMessage(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "Message not found", http.StatusNotFound)
+	case errors.Is(err, errNotAuthor):
+		http.Error(w, "Only the author can change a message", http.StatusForbidden)
+	default:
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,43 @@
+package dm
+
+import "time"
+
+// Snowflake ids are sent as strings, they do not fit in a javascript number
+
+// One username opens (or finds) the one to one conversation, more make a group
+type OpenConversationModel struct {
+	Usernames []string `json:"usernames"`
+}
+
+type SendMessageModel struct {
+	ConversationID int64  `json:"conversation_id,string"`
+	Content        string `json:"content"`
+}
+
+type EditMessageModel struct {
+	ID      int64  `json:"id,string"`
+	Content string `json:"content"`
+}
+
+type DeleteMessageModel struct {
+	ID int64 `json:"id,string"`
+}
+
+type ConversationResponse struct {
+	ID             int64            `json:"id,string" db:"id"`
+	IsGroup        bool             `json:"is_group" db:"is_group"`
+	Participants   []string         `json:"participants" db:"-"`
+	LastMessage    *MessageResponse `json:"last_message" db:"-"`
+	LastMessageID  *int64           `json:"-" db:"last_message_id"`
+	LastActivityID int64            `json:"last_activity_id,string" db:"last_activity_id"`
+	LastActivityAt time.Time        `json:"last_activity_at" db:"-"`
+}
+
+type MessageResponse struct {
+	ID             int64      `json:"id,string" db:"id"`
+	ConversationID int64      `json:"conversation_id,string" db:"conversation_id"`
+	Author         string     `json:"author" db:"author"`
+	Content        string     `json:"content" db:"content"`
+	EditedAt       *time.Time `json:"edited_at" db:"edited_at"`
+	CreatedAt      time.Time  `json:"created_at" db:"created_at"`
+}
@@ -0,0 +1,353 @@
+package emoji
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"pingless/internal/auditlog"
+	"pingless/internal/events"
+	"pingless/internal/fileutil"
+	"pingless/internal/snowflake"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+NOTE : This file deal with the custom emoji of the server
+
+An emoji is uploaded as multipart form with the image in "emoji" and its
+name in "name". Static images are converted to webp, animated ones are kept
+as GIF and only accepted when GifAllowed is set. Names are 2 to 32 letters,
+digits or underscores and unique whatever the case. Static and animated
+emoji each have their own limit. Every change is written to audit_log and
+the whole list is sent as EMOJIS_UPDATE.
+*/
+
+const (
+	MAX_STATIC_EMOJIS   = 50
+	MAX_ANIMATED_EMOJIS = 50
+	MAX_EMOJI_SIZE      = 512 << 10 // 512KB
+	EMOJI_DIR           = "emoji"
+)
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9_]{2,32}$`)
+
+var errNameTaken = errors.New("emoji name taken")
+
+func UploadEmoji(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	config := fileutil.NewFileUploadConfig(
+		"emoji",
+		MAX_EMOJI_SIZE,
+		map[string]bool{"image/jpeg": true, "image/png": true, "image/webp": true},
+		EMOJI_DIR,
+		"emoji",
+		".webp",
+		true,
+	)
+	upload(w, r, db, config, false)
+}
+
+func UploadEmojiGif(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	config := fileutil.NewFileUploadConfig(
+		"emoji",
+		MAX_EMOJI_SIZE,
+		map[string]bool{"image/gif": true},
+		EMOJI_DIR,
+		"emoji",
+		".gif",
+		false,
+	)
+	upload(w, r, db, config, true)
+}
+
+func upload(w http.ResponseWriter, r *http.Request, db *sqlx.DB, config *fileutil.FileUploadConfig, animated bool) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	file, ok := fileutil.SaveUpload(w, r, config)
+	if !ok {
+		return
+	}
+	// The file is only kept once its row is in
+	saved := false
+	defer func() {
+		if !saved {
+			os.Remove(file.Path)
+		}
+	}()
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if !validName.MatchString(name) {
+		http.Error(w, "Name must be 2 to 32 letters, digits or _", http.StatusBadRequest)
+		return
+	}
+
+	limit := MAX_STATIC_EMOJIS
+	if animated {
+		limit = MAX_ANIMATED_EMOJIS
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var count int
+	if err := tx.Get(&count, "SELECT COUNT(*) FROM emojis WHERE animated = ?", animated); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if count >= limit {
+		http.Error(w, fmt.Sprintf("The server has its %d emoji of this kind", limit), http.StatusBadRequest)
+		return
+	}
+	if err := nameFree(tx, name, 0); err != nil {
+		emojiError(w, err)
+		return
+	}
+
+	id := snowflake.Next()
+	now := time.Now()
+	_, err = tx.Exec(`
+		INSERT INTO emojis (id, name, file_name, file_size, mime_type, hash, animated, created_by, created_at)
+		SELECT ?, ?, ?, ?, ?, ?, ?, id, ? FROM users WHERE username = ?`,
+		id, name, file.FileName, file.Size, file.MimeType, file.Hash, animated, now, username)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	saved = true
+
+	publishEmojis(db)
+	auditlog.Record(db, auditlog.AuditLog{
+		UserName: username,
+		Action:   "create_emoji",
+		Target:   "emoji",
+		Metadata: map[string]string{
+			"id":       strconv.FormatInt(id, 10),
+			"name":     name,
+			"animated": strconv.FormatBool(animated),
+		},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(EmojiResponse{
+		ID:        id,
+		Name:      name,
+		URL:       emojiURL(file.FileName),
+		Animated:  animated,
+		CreatedBy: &username,
+		CreatedAt: now,
+	})
+}
+
+func ListEmojis(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	list, err := emojiList(db)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func RenameEmoji(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var rename RenameEmojiModel
+	if err := json.NewDecoder(r.Body).Decode(&rename); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(rename.Name)
+	if !validName.MatchString(name) {
+		http.Error(w, "Name must be 2 to 32 letters, digits or _", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var old string
+	if err := tx.Get(&old, "SELECT name FROM emojis WHERE id = ?", rename.ID); err != nil {
+		emojiError(w, err)
+		return
+	}
+	if err := nameFree(tx, name, rename.ID); err != nil {
+		emojiError(w, err)
+		return
+	}
+	if _, err := tx.Exec("UPDATE emojis SET name = ? WHERE id = ?", name, rename.ID); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	publishEmojis(db)
+	auditlog.Record(db, auditlog.AuditLog{
+		UserName: username,
+		Action:   "rename_emoji",
+		Target:   "emoji",
+		Metadata: map[string]string{
+			"id":  strconv.FormatInt(rename.ID, 10),
+			"old": old,
+			"new": name,
+		},
+	})
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("Renamed\n"))
+}
+
+func DeleteEmoji(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var del DeleteEmojiModel
+	if err := json.NewDecoder(r.Body).Decode(&del); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	var emoji EmojiResponse
+	if err := db.Get(&emoji, "SELECT id, name, file_name, animated, created_at FROM emojis WHERE id = ?", del.ID); err != nil {
+		emojiError(w, err)
+		return
+	}
+	if _, err := db.Exec("DELETE FROM emojis WHERE id = ?", del.ID); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if err := os.Remove(filepath.Join("uploads", EMOJI_DIR, emoji.FileName)); err != nil {
+		log.Println(err)
+	}
+
+	publishEmojis(db)
+	auditlog.Record(db, auditlog.AuditLog{
+		UserName: username,
+		Action:   "delete_emoji",
+		Target:   "emoji",
+		Metadata: map[string]string{
+			"id":   strconv.FormatInt(del.ID, 10),
+			"name": emoji.Name,
+		},
+	})
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("Emoji Deleted\n"))
+}
+
+// nameFree fails with errNameTaken when another emoji than id has name
+func nameFree(tx *sqlx.Tx, name string, id int64) error {
+	var taken bool
+	if err := tx.Get(&taken, "SELECT EXISTS(SELECT 1 FROM emojis WHERE name = ? AND id != ?)", name, id); err != nil {
+		return err
+	}
+	if taken {
+		return errNameTaken
+	}
+	return nil
+}
+
+func emojiError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "Emoji not found", http.StatusNotFound)
+	case errors.Is(err, errNameTaken):
+		http.Error(w, "An emoji already has this name", http.StatusConflict)
+	default:
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+	}
+}
+
+// uploads/ is served as /images/
+func emojiURL(fileName string) string {
+	return "/images/" + EMOJI_DIR + "/" + fileName
+}
+
+// emojiList is every emoji ordered by name
+func emojiList(db *sqlx.DB) ([]EmojiResponse, error) {
+	list := []EmojiResponse{}
+	err := db.Select(&list, `
+		SELECT e.id, e.name, e.file_name, e.animated, u.username AS created_by, e.created_at
+		FROM emojis e
+		LEFT JOIN users u ON e.created_by = u.id
+		ORDER BY e.name COLLATE NOCASE`)
+	for i := range list {
+		list[i].URL = emojiURL(list[i].FileName)
+	}
+	return list, err
+}
+
+func publishEmojis(db *sqlx.DB) {
+	list, err := emojiList(db)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	events.Publish(db, events.EMOJIS_UPDATE, list)
+}
@@ -0,0 +1,24 @@
+package emoji
+
+import "time"
+
+// Snowflake ids are sent as strings, they do not fit in a javascript number
+
+type RenameEmojiModel struct {
+	ID   int64  `json:"id,string"`
+	Name string `json:"name"`
+}
+
+type DeleteEmojiModel struct {
+	ID int64 `json:"id,string"`
+}
+
+type EmojiResponse struct {
+	ID        int64     `json:"id,string" db:"id"`
+	Name      string    `json:"name" db:"name"`
+	URL       string    `json:"url" db:"-"`
+	FileName  string    `json:"-" db:"file_name"`
+	Animated  bool      `json:"animated" db:"animated"`
+	CreatedBy *string   `json:"created_by" db:"created_by"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
@@ -0,0 +1,381 @@
+package gateway
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"pingless/internal/events"
+	"pingless/routes/user"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+NOTE : This file deal with the websocket gateway
+
+	client                               server
+	                                <-   hello {heartbeat_interval}
+	identify {token}                ->
+	                                <-   ready {session_id, username, seq}
+	                                <-   dispatch {t, s, d} ...
+	heartbeat                       ->
+	                                <-   heartbeat_ack {seq}
+
+Every dispatch carries the sequence number of its event. After a disconnect
+the client opens a new socket and sends resume {token, session_id, seq}
+instead of identify, with seq the last sequence it got. It is sent every
+event after seq and then resumed. This works for RESUME_WINDOW after the
+disconnect and while the events are still in the event log, otherwise
+the client gets invalid_session and has to identify again.
+
+The token is an access token, or a PAT with the messages:read scope. It is
+checked again on every heartbeat, a revoked session or token is kicked out.
+*/
+
+const (
+	HEARTBEAT_INTERVAL = 30 * time.Second
+	HEARTBEAT_GRACE    = 15 * time.Second
+	IDENTIFY_TIMEOUT   = 10 * time.Second
+	RESUME_WINDOW      = 2 * time.Minute
+	WRITE_TIMEOUT      = 10 * time.Second
+	MAX_FRAME_SIZE     = 4096
+)
+
+// Ops
+const (
+	OP_HELLO           = "hello"
+	OP_IDENTIFY        = "identify"
+	OP_RESUME          = "resume"
+	OP_READY           = "ready"
+	OP_RESUMED         = "resumed"
+	OP_DISPATCH        = "dispatch"
+	OP_HEARTBEAT       = "heartbeat"
+	OP_HEARTBEAT_ACK   = "heartbeat_ack"
+	OP_INVALID_SESSION = "invalid_session"
+)
+
+// Close codes, 4000-4999 are left to applications
+const (
+	CLOSE_UNKNOWN_OP        = 4001
+	CLOSE_DECODE_ERROR      = 4002
+	CLOSE_NOT_AUTHENTICATED = 4003
+	CLOSE_INVALID_SESSION   = 4004
+	CLOSE_HEARTBEAT_TIMEOUT = 4005
+	// The client did not read its events fast enough, it can resume
+	CLOSE_TOO_SLOW = 4006
+)
+
+var upgrader = websocket.Upgrader{
+	// The token comes in identify and not from a cookie, a page of another
+	// origin gains nothing by opening the socket
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+type session struct {
+	username       string
+	connected      bool
+	disconnectedAt time.Time
+}
+
+var (
+	sessionsMu sync.Mutex
+	sessions   = map[string]*session{}
+)
+
+type conn struct {
+	ws *websocket.Conn
+	mu sync.Mutex
+	// Sequence of the last event sent
+	seq atomic.Int64
+}
+
+func (c *conn) send(frame Frame) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ws.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+	return c.ws.WriteJSON(frame)
+}
+
+func (c *conn) dispatch(event events.Event) error {
+	if err := c.send(Frame{Op: OP_DISPATCH, Type: event.Type, Seq: event.Seq, Data: event.Data}); err != nil {
+		return err
+	}
+	c.seq.Store(event.Seq)
+	return nil
+}
+
+func (c *conn) close(code int, reason string) {
+	c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(WRITE_TIMEOUT))
+	c.ws.Close()
+}
+
+func (c *conn) invalidSession(resumable bool, reason string) {
+	c.send(Frame{Op: OP_INVALID_SESSION, Data: InvalidSessionData{Resumable: resumable, Reason: reason}})
+	c.close(CLOSE_INVALID_SESSION, reason)
+}
+
+func Gateway(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade already answered the request
+		log.Println(err)
+		return
+	}
+	defer ws.Close()
+	ws.SetReadLimit(MAX_FRAME_SIZE)
+	c := &conn{ws: ws}
+
+	if err := c.send(Frame{Op: OP_HELLO, Data: HelloData{HeartbeatInterval: HEARTBEAT_INTERVAL.Milliseconds()}}); err != nil {
+		return
+	}
+
+	ws.SetReadDeadline(time.Now().Add(IDENTIFY_TIMEOUT))
+	frame, ok := readFrame(c)
+	if !ok {
+		return
+	}
+
+	var sessionID string
+	var claims jwt.MapClaims
+	var sub *events.Subscription
+	switch frame.Op {
+	case OP_IDENTIFY:
+		sessionID, claims, sub, ok = identify(c, r, db, frame)
+	case OP_RESUME:
+		sessionID, claims, sub, ok = resume(c, r, db, frame)
+	default:
+		c.close(CLOSE_NOT_AUTHENTICATED, "Identify first")
+		return
+	}
+	if !ok {
+		return
+	}
+
+	done := make(chan struct{})
+	go pump(c, sub, done)
+
+	for {
+		ws.SetReadDeadline(time.Now().Add(HEARTBEAT_INTERVAL + HEARTBEAT_GRACE))
+		frame, ok := readFrame(c)
+		if !ok {
+			break
+		}
+		if frame.Op != OP_HEARTBEAT {
+			c.close(CLOSE_UNKNOWN_OP, "Unknown op "+frame.Op)
+			break
+		}
+		valid, err := user.StillAuthenticated(db, r, claims)
+		if err != nil {
+			log.Println(err)
+			c.close(websocket.CloseInternalServerErr, "DB ERROR")
+			break
+		}
+		if !valid {
+			forgetSession(sessionID)
+			c.invalidSession(false, "Session revoked")
+			break
+		}
+		if err := c.send(Frame{Op: OP_HEARTBEAT_ACK, Data: SeqData{Seq: c.seq.Load()}}); err != nil {
+			break
+		}
+	}
+
+	close(done)
+	sub.Close()
+	sessionsMu.Lock()
+	if s, ok := sessions[sessionID]; ok {
+		s.connected = false
+		s.disconnectedAt = time.Now()
+	}
+	sessionsMu.Unlock()
+}
+
+// readFrame reads the next frame, the connection is closed when it is not
+// one
+func readFrame(c *conn) (ClientFrame, bool) {
+	var frame ClientFrame
+	_, raw, err := c.ws.ReadMessage()
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			c.close(CLOSE_HEARTBEAT_TIMEOUT, "Timed out")
+		}
+		return frame, false
+	}
+	if err := json.Unmarshal(raw, &frame); err != nil {
+		c.close(CLOSE_DECODE_ERROR, "Invalid JSON")
+		return frame, false
+	}
+	return frame, true
+}
+
+// pump sends the events of sub until done
+func pump(c *conn, sub *events.Subscription, done chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case event, ok := <-sub.C:
+			if !ok {
+				select {
+				case <-done:
+				default:
+					c.close(CLOSE_TOO_SLOW, "Too slow, resume")
+				}
+				return
+			}
+			if err := c.dispatch(event); err != nil {
+				c.ws.Close()
+				return
+			}
+		}
+	}
+}
+
+func authenticate(c *conn, r *http.Request, db *sqlx.DB, token string) (jwt.MapClaims, string, bool) {
+	claims, err := user.Authenticate(db, r, token, user.SCOPE_MESSAGES_READ)
+	if err != nil {
+		var authErr *user.AuthError
+		if errors.As(err, &authErr) {
+			c.send(Frame{Op: OP_INVALID_SESSION, Data: InvalidSessionData{Resumable: false, Reason: authErr.Message}})
+			c.close(CLOSE_NOT_AUTHENTICATED, authErr.Message)
+			return nil, "", false
+		}
+		log.Println(err)
+		c.close(websocket.CloseInternalServerErr, "DB ERROR")
+		return nil, "", false
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		c.close(CLOSE_NOT_AUTHENTICATED, "Invalid token payload")
+		return nil, "", false
+	}
+	return claims, username, true
+}
+
+func identify(c *conn, r *http.Request, db *sqlx.DB, frame ClientFrame) (string, jwt.MapClaims, *events.Subscription, bool) {
+	var data IdentifyData
+	if err := json.Unmarshal(frame.Data, &data); err != nil {
+		c.close(CLOSE_DECODE_ERROR, "Invalid JSON")
+		return "", nil, nil, false
+	}
+	claims, username, ok := authenticate(c, r, db, data.Token)
+	if !ok {
+		return "", nil, nil, false
+	}
+
+	sessionID, err := newSessionID()
+	if err != nil {
+		log.Println(err)
+		c.close(websocket.CloseInternalServerErr, "Session Error")
+		return "", nil, nil, false
+	}
+	sessionsMu.Lock()
+	for id, s := range sessions {
+		if !s.connected && time.Since(s.disconnectedAt) > RESUME_WINDOW {
+			delete(sessions, id)
+		}
+	}
+	sessions[sessionID] = &session{username: username, connected: true}
+	sessionsMu.Unlock()
+
+	seq := events.Seq()
+	missed, sub, _, err := events.Subscribe(db, seq, username)
+	if err != nil {
+		log.Println(err)
+		forgetSession(sessionID)
+		c.close(websocket.CloseInternalServerErr, "DB ERROR")
+		return "", nil, nil, false
+	}
+	c.seq.Store(seq)
+	if err := c.send(Frame{Op: OP_READY, Data: ReadyData{SessionID: sessionID, Username: username, Seq: seq}}); err != nil {
+		sub.Close()
+		return "", nil, nil, false
+	}
+	// Published between Seq and Subscribe
+	for _, event := range missed {
+		if err := c.dispatch(event); err != nil {
+			sub.Close()
+			return "", nil, nil, false
+		}
+	}
+	return sessionID, claims, sub, true
+}
+
+func resume(c *conn, r *http.Request, db *sqlx.DB, frame ClientFrame) (string, jwt.MapClaims, *events.Subscription, bool) {
+	var data ResumeData
+	if err := json.Unmarshal(frame.Data, &data); err != nil {
+		c.close(CLOSE_DECODE_ERROR, "Invalid JSON")
+		return "", nil, nil, false
+	}
+	claims, username, ok := authenticate(c, r, db, data.Token)
+	if !ok {
+		return "", nil, nil, false
+	}
+
+	sessionsMu.Lock()
+	s, ok := sessions[data.SessionID]
+	ok = ok && s.username == username && !s.connected && time.Since(s.disconnectedAt) <= RESUME_WINDOW
+	if ok {
+		s.connected = true
+	}
+	sessionsMu.Unlock()
+	if !ok {
+		c.invalidSession(false, "Session cannot be resumed")
+		return "", nil, nil, false
+	}
+
+	missed, sub, ok, err := events.Subscribe(db, data.Seq, username)
+	if err != nil {
+		log.Println(err)
+		forgetSession(data.SessionID)
+		c.close(websocket.CloseInternalServerErr, "DB ERROR")
+		return "", nil, nil, false
+	}
+	if !ok {
+		forgetSession(data.SessionID)
+		c.invalidSession(false, "Missed events are gone")
+		return "", nil, nil, false
+	}
+	c.seq.Store(data.Seq)
+	fail := func() (string, jwt.MapClaims, *events.Subscription, bool) {
+		sub.Close()
+		sessionsMu.Lock()
+		s.connected = false
+		s.disconnectedAt = time.Now()
+		sessionsMu.Unlock()
+		return "", nil, nil, false
+	}
+	for _, event := range missed {
+		if err := c.dispatch(event); err != nil {
+			return fail()
+		}
+	}
+	if err := c.send(Frame{Op: OP_RESUMED, Data: SeqData{Seq: c.seq.Load()}}); err != nil {
+		return fail()
+	}
+	return data.SessionID, claims, sub, true
+}
+
+func forgetSession(sessionID string) {
+	sessionsMu.Lock()
+	delete(sessions, sessionID)
+	sessionsMu.Unlock()
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
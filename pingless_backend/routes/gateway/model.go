@@ -0,0 +1,47 @@
+package gateway
+
+import "encoding/json"
+
+// Frame is what goes over the socket in both directions. t and s are only
+// set on dispatch.
+type Frame struct {
+	Op   string `json:"op"`
+	Type string `json:"t,omitempty"`
+	Seq  int64  `json:"s,omitempty"`
+	Data any    `json:"d,omitempty"`
+}
+
+type ClientFrame struct {
+	Op   string          `json:"op"`
+	Data json.RawMessage `json:"d"`
+}
+
+type HelloData struct {
+	HeartbeatInterval int64 `json:"heartbeat_interval"`
+}
+
+type IdentifyData struct {
+	Token string `json:"token"`
+}
+
+// Seq is the last sequence the client received
+type ResumeData struct {
+	Token     string `json:"token"`
+	SessionID string `json:"session_id"`
+	Seq       int64  `json:"seq"`
+}
+
+type ReadyData struct {
+	SessionID string `json:"session_id"`
+	Username  string `json:"username"`
+	Seq       int64  `json:"seq"`
+}
+
+type SeqData struct {
+	Seq int64 `json:"seq"`
+}
+
+type InvalidSessionData struct {
+	Resumable bool   `json:"resumable"`
+	Reason    string `json:"reason"`
+}
@@ -0,0 +1,132 @@
+package gateway
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"pingless/internal/events"
+	"pingless/routes/user"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+NOTE : This file deal with the Server-Sent Events feed
+
+The same events as the gateway for clients that cannot keep a websocket
+(proxies, curl). Each event is sent as
+
+	id: <seq>
+	event: <type>
+	data: <json>
+
+EventSource sends the last id back in Last-Event-ID when it reconnects and
+the events missed since are replayed from the event log (?last_event_id= does
+the same for the first connection). When they are not in the log anymore a
+"RESET" event tells the client to reload everything, the stream goes on from
+the current sequence.
+*/
+
+const SSE_PING_INTERVAL = 20 * time.Second
+
+func Events(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	after := events.Seq()
+	if lastID != "" {
+		id, err := strconv.ParseInt(lastID, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		after = id
+	}
+
+	missed, sub, ok, err := events.Subscribe(db, after, username)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	reset := !ok
+	if reset {
+		after = events.Seq()
+		missed, sub, _, err = events.Subscribe(db, after, username)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "DB ERROR", http.StatusInternalServerError)
+			return
+		}
+	}
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// nginx would buffer the stream otherwise
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if reset {
+		fmt.Fprintf(w, "id: %d\nevent: RESET\ndata: {}\n\n", after)
+	}
+	for _, event := range missed {
+		writeEvent(w, event)
+	}
+	flusher.Flush()
+
+	ping := time.NewTicker(SSE_PING_INTERVAL)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-sub.C:
+			if !ok {
+				// Too slow, the client reconnects with Last-Event-ID
+				return
+			}
+			writeEvent(w, event)
+			flusher.Flush()
+		case <-ping.C:
+			valid, err := user.StillAuthenticated(db, r, claims)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			if !valid {
+				fmt.Fprint(w, "event: INVALID_SESSION\ndata: {}\n\n")
+				flusher.Flush()
+				return
+			}
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event events.Event) {
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.Type, event.Data)
+}
@@ -0,0 +1,273 @@
+package invite
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/big"
+	"net/http"
+	"pingless/internal/auditlog"
+	"pingless/internal/permissions"
+	"pingless/routes/role"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+NOTE : This file deal with invite codes
+
+An invite lets one person join an invite only server. Invites can be
+limited in uses and time, and can hand out a role other than Member. An
+invite without max_uses or expires_in has no limit of that kind.
+*/
+
+const (
+	CODE_LENGTH  = 8
+	MAX_USES     = 1000
+	MAX_LIFETIME = (time.Hour * 24) * 30
+)
+
+var ErrInvalidInvite = errors.New("invalid or expired invite")
+
+const codeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz23456789"
+
+func CreateInvite(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var invite CreateInviteModel
+	if err := json.NewDecoder(r.Body).Decode(&invite); err != nil {
+		log.Println(err)
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if invite.MaxUses < 0 || invite.MaxUses > MAX_USES {
+		http.Error(w, "Allowed max_uses 0 ≤ uses ≤ 1000", http.StatusBadRequest)
+		return
+	}
+	if invite.ExpiresIn < 0 || time.Duration(invite.ExpiresIn)*time.Second > MAX_LIFETIME {
+		http.Error(w, "Allowed expires_in 0 (never) or up to 30 days", http.StatusBadRequest)
+		return
+	}
+	if invite.RoleID != nil {
+		if *invite.RoleID == permissions.OWNER_ROLE {
+			http.Error(w, "Invite cannot grant the Owner role", http.StatusBadRequest)
+			return
+		}
+		var exists bool
+		if err := db.Get(&exists, "SELECT EXISTS(SELECT 1 FROM roles WHERE id = ?)", *invite.RoleID); err != nil {
+			log.Println(err)
+			http.Error(w, "DB ERROR", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Role not found", http.StatusBadRequest)
+			return
+		}
+		allowed, err := role.CanAssign(db, username, *invite.RoleID)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "DB ERROR", http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			http.Error(w, "Invite can only grant a role below yours", http.StatusForbidden)
+			return
+		}
+	}
+
+	var userID int
+	if err := db.Get(&userID, "SELECT id FROM users WHERE username = ?", username); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	code, err := generateCode()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Code Error", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	var expiresAt *time.Time
+	if invite.ExpiresIn > 0 {
+		t := now.Add(time.Duration(invite.ExpiresIn) * time.Second)
+		expiresAt = &t
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO invites (code, created_by, role_id, max_uses, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		code, userID, invite.RoleID, invite.MaxUses, expiresAt, now,
+	)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	metadata := map[string]string{
+		"code":     code,
+		"max_uses": strconv.Itoa(invite.MaxUses),
+	}
+	if invite.RoleID != nil {
+		metadata["role_id"] = strconv.Itoa(*invite.RoleID)
+	}
+	if expiresAt != nil {
+		metadata["expires_at"] = expiresAt.UTC().Format(time.RFC3339)
+	}
+	auditlog.Record(db, auditlog.AuditLog{
+		UserName: username,
+		Action:   "create_invite",
+		Target:   "invite",
+		Metadata: metadata,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(InviteResponse{
+		Code:      code,
+		CreatedBy: username,
+		RoleID:    invite.RoleID,
+		MaxUses:   invite.MaxUses,
+		ExpiresAt: expiresAt,
+		CreatedAt: now,
+	})
+}
+
+// ListInvites returns the invites that can still be used
+func ListInvites(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	invites := []InviteResponse{}
+	err := db.Select(&invites, `
+		SELECT i.code, u.username AS created_by, i.role_id, i.max_uses, i.uses, i.expires_at, i.created_at
+		FROM invites i
+		JOIN users u ON i.created_by = u.id
+		WHERE i.revoked = FALSE AND (i.max_uses = 0 OR i.uses < i.max_uses)
+		ORDER BY i.created_at DESC`)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	// Expired invites are filtered here, expires_at is compared as time not text
+	active := []InviteResponse{}
+	now := time.Now()
+	for _, invite := range invites {
+		if invite.ExpiresAt == nil || now.Before(*invite.ExpiresAt) {
+			active = append(active, invite)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(active)
+}
+
+func RevokeInvite(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var revoke RevokeInviteModel
+	if err := json.NewDecoder(r.Body).Decode(&revoke); err != nil {
+		log.Println(err)
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	res, err := db.Exec("UPDATE invites SET revoked = TRUE WHERE code = ? AND revoked = FALSE", revoke.Code)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Invite not found", http.StatusNotFound)
+		return
+	}
+
+	auditlog.Record(db, auditlog.AuditLog{
+		UserName: username,
+		Action:   "revoke_invite",
+		Target:   "invite",
+		Metadata: map[string]string{
+			"code": revoke.Code,
+		},
+	})
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("Invite Revoked\n"))
+}
+
+// Redeem uses up one use of the invite inside tx and returns the role it
+// grants, nil means the default role. It returns ErrInvalidInvite when the
+// code is unknown, revoked, expired or used up.
+func Redeem(tx *sqlx.Tx, code string) (*int, error) {
+	var invite struct {
+		RoleID    *int       `db:"role_id"`
+		Revoked   bool       `db:"revoked"`
+		ExpiresAt *time.Time `db:"expires_at"`
+	}
+	err := tx.Get(&invite, "SELECT role_id, revoked, expires_at FROM invites WHERE code = ?", code)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidInvite
+		}
+		return nil, err
+	}
+	if invite.Revoked || (invite.ExpiresAt != nil && time.Now().After(*invite.ExpiresAt)) {
+		return nil, ErrInvalidInvite
+	}
+
+	// The use limit is checked by the update itself so two signups racing
+	// for the last use cannot both get in
+	res, err := tx.Exec(`
+		UPDATE invites SET uses = uses + 1
+		WHERE code = ? AND (max_uses = 0 OR uses < max_uses)`, code)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, ErrInvalidInvite
+	}
+	return invite.RoleID, nil
+}
+
+func generateCode() (string, error) {
+	code := make([]byte, CODE_LENGTH)
+	max := big.NewInt(int64(len(codeAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = codeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
@@ -0,0 +1,23 @@
+package invite
+
+import "time"
+
+type CreateInviteModel struct {
+	MaxUses   int  `json:"max_uses"`
+	ExpiresIn int  `json:"expires_in"` // seconds, 0 = never
+	RoleID    *int `json:"role_id"`
+}
+
+type RevokeInviteModel struct {
+	Code string `json:"code"`
+}
+
+type InviteResponse struct {
+	Code      string     `json:"code" db:"code"`
+	CreatedBy string     `json:"created_by" db:"created_by"`
+	RoleID    *int       `json:"role_id" db:"role_id"`
+	MaxUses   int        `json:"max_uses" db:"max_uses"`
+	Uses      int        `json:"uses" db:"uses"`
+	ExpiresAt *time.Time `json:"expires_at" db:"expires_at"`
+	CreatedAt time.Time  `json:"created_at" db:"created_at"`
+}
@@ -0,0 +1,52 @@
+package role
+
+type CreateRoleModel struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Color       string `json:"color"`              // #RRGGBB or ""
+	Position    *int   `json:"position"`           // default 1, just above Member
+	Permissions *int64 `json:"permissions,string"` // bitfield, default view and send
+}
+
+// Fields left out are not changed
+type UpdateRoleModel struct {
+	ID          int     `json:"id"`
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	Color       *string `json:"color"`
+	Position    *int    `json:"position"`
+	Permissions *int64  `json:"permissions,string"`
+}
+
+type DeleteRoleModel struct {
+	ID int `json:"id"`
+}
+
+type AssignRoleModel struct {
+	Username string `json:"username"`
+	RoleID   int    `json:"role_id"`
+}
+
+type UnassignRoleModel struct {
+	Username string `json:"username"`
+	RoleID   int    `json:"role_id"`
+}
+
+// MemberRoles are the roles of a user, highest first. Color is the one of
+// the highest role that has a color.
+type MemberRoles struct {
+	IDs   []int
+	TopID int
+	Top   string
+	Color string
+}
+
+type RoleResponse struct {
+	ID          int    `json:"id" db:"id"`
+	Name        string `json:"name" db:"name"`
+	Description string `json:"description" db:"description"`
+	Color       string `json:"color" db:"color"`
+	Position    int    `json:"position" db:"position"`
+	Members     int    `json:"members" db:"members"`
+	Permissions int64  `json:"permissions,string" db:"permissions"`
+}
@@ -0,0 +1,742 @@
+package role
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"pingless/internal/auditlog"
+	"pingless/internal/events"
+	"pingless/internal/permissions"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+NOTE : This file deal with roles and who has them
+
+Roles are ordered by position, higher is above. Owner sits above every role
+and cannot be edited, given or taken here. Member is the role everybody has,
+it always stays at the bottom and cannot be deleted, given or taken.
+
+A user can have any number of roles, their permissions add up and the
+highest role with a color gives the color of the user. The place of a user
+in the hierarchy is their highest role.
+
+Nobody can create, edit, delete, give or take a role at or above their own,
+change the roles of someone at or above them, or give a role a permission
+they do not have. Every change is written to audit_log.
+*/
+
+const (
+	MAX_ROLES          = 250
+	MAX_ROLE_NAME_SIZE = 32
+	MAX_ROLE_DESC_SIZE = 200
+)
+
+var roleColor = regexp.MustCompile(`^#[0-9A-Fa-f]{6}$`)
+
+const roleSelect = `
+	SELECT r.id, r.name, COALESCE(r.description, '') AS description, r.color, r.position,
+		(SELECT COUNT(*) FROM user_roles ur WHERE ur.role_id = r.id) AS members, r.permissions
+	FROM roles r`
+
+var (
+	errRoleNotFound = errors.New("role not found")
+	errUserNotFound = errors.New("user not found")
+	errNotBelow     = errors.New("role is not below yours")
+	errPermission   = errors.New("permission you do not have")
+	errNameTaken    = errors.New("role name taken")
+	errUnknownBit   = errors.New("unknown permission bit")
+)
+
+// rankOrder sorts roles from the top, Owner first
+const rankOrder = "r.id = 1 DESC, r.position DESC, r.id"
+
+// grantable reports whether username may give perms to a role, only known
+// bits they have from any of their roles
+func grantable(q sqlx.Queryer, username string, perms int64) error {
+	if perms&^permissions.ALL != 0 {
+		return errUnknownBit
+	}
+	mine, err := permissions.Resolve(q, username, 0)
+	if err != nil {
+		return err
+	}
+	if perms&^mine != 0 {
+		return errPermission
+	}
+	return nil
+}
+
+// rank is the place of a role in the hierarchy
+func rank(id int, position int) int {
+	if id == permissions.OWNER_ROLE {
+		return math.MaxInt
+	}
+	return position
+}
+
+// callerRole is the highest role of username
+func callerRole(q sqlx.Queryer, username string) (RoleResponse, error) {
+	var role RoleResponse
+	err := sqlx.Get(q, &role, roleSelect+`
+		JOIN user_roles ur2 ON ur2.role_id = r.id
+		JOIN users u2 ON ur2.user_id = u2.id
+		WHERE u2.username = ?
+		ORDER BY `+rankOrder+`
+		LIMIT 1`, username)
+	return role, err
+}
+
+// CanAssign reports whether username may hand out roleID, for other ways of
+// giving roles like invites
+func CanAssign(db *sqlx.DB, username string, roleID int) (bool, error) {
+	caller, err := callerRole(db, username)
+	if err != nil {
+		return false, err
+	}
+	var position int
+	if err := db.Get(&position, "SELECT position FROM roles WHERE id = ?", roleID); err != nil {
+		return false, err
+	}
+	return rank(roleID, position) < rank(caller.ID, caller.Position), nil
+}
+
+// CanManageUser reports whether the highest role of username is above the
+// highest role of the user targetID
+func CanManageUser(db *sqlx.DB, username string, targetID int) (bool, error) {
+	caller, err := callerRole(db, username)
+	if err != nil {
+		return false, err
+	}
+	var target RoleResponse
+	err = db.Get(&target, roleSelect+`
+		JOIN user_roles ur2 ON ur2.role_id = r.id
+		WHERE ur2.user_id = ?
+		ORDER BY `+rankOrder+`
+		LIMIT 1`, targetID)
+	if err != nil {
+		return false, err
+	}
+	return rank(target.ID, target.Position) < rank(caller.ID, caller.Position), nil
+}
+
+func validColor(color string) (string, bool) {
+	color = strings.ToUpper(strings.TrimSpace(color))
+	return color, color == "" || roleColor.MatchString(color)
+}
+
+func validRoleName(name string) (string, bool) {
+	name = strings.TrimSpace(name)
+	size := utf8.RuneCountInString(name)
+	return name, size > 0 && size <= MAX_ROLE_NAME_SIZE
+}
+
+// nameFree fails with errNameTaken when another role than id has name
+func nameFree(tx *sqlx.Tx, name string, id int) error {
+	var taken bool
+	if err := tx.Get(&taken, "SELECT EXISTS(SELECT 1 FROM roles WHERE name = ? AND id != ?)", name, id); err != nil {
+		return err
+	}
+	if taken {
+		return errNameTaken
+	}
+	return nil
+}
+
+func roleError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errRoleNotFound):
+		http.Error(w, "Role not found", http.StatusNotFound)
+	case errors.Is(err, errUserNotFound):
+		http.Error(w, "User not found", http.StatusNotFound)
+	case errors.Is(err, errNotBelow):
+		http.Error(w, "You can only manage roles and members below your own role", http.StatusForbidden)
+	case errors.Is(err, errPermission):
+		http.Error(w, "You cannot give a permission you do not have", http.StatusForbidden)
+	case errors.Is(err, errUnknownBit):
+		http.Error(w, "Unknown permission", http.StatusBadRequest)
+	case errors.Is(err, errNameTaken):
+		http.Error(w, "A role already has this name", http.StatusConflict)
+	default:
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+	}
+}
+
+func ListRoles(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	list, err := roleList(db)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func CreateRole(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var role CreateRoleModel
+	if err := json.NewDecoder(r.Body).Decode(&role); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	name, ok := validRoleName(role.Name)
+	if !ok {
+		http.Error(w, "Name must be 1 to 32 characters", http.StatusBadRequest)
+		return
+	}
+	description := strings.TrimSpace(role.Description)
+	if utf8.RuneCountInString(description) > MAX_ROLE_DESC_SIZE {
+		http.Error(w, "Description can be at most 200 characters", http.StatusBadRequest)
+		return
+	}
+	color, ok := validColor(role.Color)
+	if !ok {
+		http.Error(w, "color must be #RRGGBB", http.StatusBadRequest)
+		return
+	}
+	position := 1
+	if role.Position != nil {
+		position = *role.Position
+	}
+	if position < 1 {
+		http.Error(w, "Position must be at least 1, Member is at 0", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	caller, err := callerRole(tx, username)
+	if err != nil {
+		roleError(w, err)
+		return
+	}
+	if position >= rank(caller.ID, caller.Position) {
+		roleError(w, errNotBelow)
+		return
+	}
+	perms := permissions.DEFAULT
+	if role.Permissions != nil {
+		perms = *role.Permissions
+	}
+	if err := grantable(tx, username, perms); err != nil {
+		roleError(w, err)
+		return
+	}
+	var count int
+	if err := tx.Get(&count, "SELECT COUNT(*) FROM roles"); err != nil {
+		roleError(w, err)
+		return
+	}
+	if count >= MAX_ROLES {
+		http.Error(w, "Too many roles", http.StatusBadRequest)
+		return
+	}
+	if err := nameFree(tx, name, 0); err != nil {
+		roleError(w, err)
+		return
+	}
+
+	res, err := tx.Exec("INSERT INTO roles (name, description, permissions, color, position) VALUES (?, ?, ?, ?, ?)",
+		name, description, perms, color, position)
+	if err != nil {
+		roleError(w, err)
+		return
+	}
+	id, _ := res.LastInsertId()
+	if err := tx.Commit(); err != nil {
+		roleError(w, err)
+		return
+	}
+
+	publishRoles(db)
+	auditlog.Record(db, auditlog.AuditLog{
+		UserName: username,
+		Action:   "create_role",
+		Target:   "role",
+		Metadata: map[string]string{
+			"id":          strconv.FormatInt(id, 10),
+			"name":        name,
+			"position":    strconv.Itoa(position),
+			"permissions": permissions.Names(perms),
+		},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(RoleResponse{
+		ID:          int(id),
+		Name:        name,
+		Description: description,
+		Color:       color,
+		Position:    position,
+		Permissions: perms,
+	})
+}
+
+func UpdateRole(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var update UpdateRoleModel
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if update.ID == permissions.OWNER_ROLE {
+		http.Error(w, "The Owner role cannot be edited", http.StatusForbidden)
+		return
+	}
+
+	sets := []string{}
+	args := []any{}
+	metadata := map[string]string{"id": strconv.Itoa(update.ID)}
+	if update.Name != nil {
+		name, ok := validRoleName(*update.Name)
+		if !ok {
+			http.Error(w, "Name must be 1 to 32 characters", http.StatusBadRequest)
+			return
+		}
+		update.Name = &name
+		sets = append(sets, "name = ?")
+		args = append(args, name)
+		metadata["name"] = name
+	}
+	if update.Description != nil {
+		description := strings.TrimSpace(*update.Description)
+		if utf8.RuneCountInString(description) > MAX_ROLE_DESC_SIZE {
+			http.Error(w, "Description can be at most 200 characters", http.StatusBadRequest)
+			return
+		}
+		sets = append(sets, "description = ?")
+		args = append(args, description)
+		metadata["description"] = description
+	}
+	if update.Color != nil {
+		color, ok := validColor(*update.Color)
+		if !ok {
+			http.Error(w, "color must be #RRGGBB", http.StatusBadRequest)
+			return
+		}
+		sets = append(sets, "color = ?")
+		args = append(args, color)
+		metadata["color"] = color
+	}
+	if update.Position != nil {
+		if update.ID == permissions.MEMBER_ROLE {
+			http.Error(w, "Member always stays at position 0", http.StatusBadRequest)
+			return
+		}
+		if *update.Position < 1 {
+			http.Error(w, "Position must be at least 1, Member is at 0", http.StatusBadRequest)
+			return
+		}
+		sets = append(sets, "position = ?")
+		args = append(args, *update.Position)
+		metadata["position"] = strconv.Itoa(*update.Position)
+	}
+	if len(sets) == 0 && update.Permissions == nil {
+		http.Error(w, "Nothing to update", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	caller, err := callerRole(tx, username)
+	if err != nil {
+		roleError(w, err)
+		return
+	}
+	var position int
+	if err := tx.Get(&position, "SELECT position FROM roles WHERE id = ?", update.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = errRoleNotFound
+		}
+		roleError(w, err)
+		return
+	}
+	callerRank := rank(caller.ID, caller.Position)
+	if position >= callerRank || (update.Position != nil && *update.Position >= callerRank) {
+		roleError(w, errNotBelow)
+		return
+	}
+	if update.Name != nil {
+		if err := nameFree(tx, *update.Name, update.ID); err != nil {
+			roleError(w, err)
+			return
+		}
+	}
+
+	if update.Permissions != nil {
+		if err := grantable(tx, username, *update.Permissions); err != nil {
+			roleError(w, err)
+			return
+		}
+		sets = append(sets, "permissions = ?")
+		args = append(args, *update.Permissions)
+		metadata["permissions"] = permissions.Names(*update.Permissions)
+	}
+	if len(sets) > 0 {
+		if _, err := tx.Exec("UPDATE roles SET "+strings.Join(sets, ", ")+" WHERE id = ?", append(args, update.ID)...); err != nil {
+			roleError(w, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		roleError(w, err)
+		return
+	}
+
+	publishRoles(db)
+	auditlog.Record(db, auditlog.AuditLog{
+		UserName: username,
+		Action:   "update_role",
+		Target:   "role",
+		Metadata: metadata,
+	})
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("Role Updated\n"))
+}
+
+// DeleteRole moves the members of the role to Member
+func DeleteRole(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var del DeleteRoleModel
+	if err := json.NewDecoder(r.Body).Decode(&del); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if del.ID == permissions.OWNER_ROLE || del.ID == permissions.MEMBER_ROLE {
+		http.Error(w, "Owner and Member cannot be deleted", http.StatusForbidden)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	caller, err := callerRole(tx, username)
+	if err != nil {
+		roleError(w, err)
+		return
+	}
+	var target struct {
+		Name     string `db:"name"`
+		Position int    `db:"position"`
+	}
+	if err := tx.Get(&target, "SELECT name, position FROM roles WHERE id = ?", del.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = errRoleNotFound
+		}
+		roleError(w, err)
+		return
+	}
+	if target.Position >= rank(caller.ID, caller.Position) {
+		roleError(w, errNotBelow)
+		return
+	}
+
+	var members []string
+	err = tx.Select(&members, "SELECT u.username FROM users u JOIN user_roles ur ON ur.user_id = u.id WHERE ur.role_id = ?", del.ID)
+	if err != nil {
+		roleError(w, err)
+		return
+	}
+	// Foreign keys are not enforced, everything pointing at the role is
+	// cleaned up here
+	if _, err := tx.Exec("DELETE FROM user_roles WHERE role_id = ?", del.ID); err != nil {
+		roleError(w, err)
+		return
+	}
+	if _, err := tx.Exec("UPDATE invites SET role_id = NULL WHERE role_id = ?", del.ID); err != nil {
+		roleError(w, err)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM roles WHERE id = ?", del.ID); err != nil {
+		roleError(w, err)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM channel_overwrites WHERE target_type = ? AND target_id = ?", permissions.TARGET_ROLE, del.ID); err != nil {
+		roleError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		roleError(w, err)
+		return
+	}
+
+	publishRoles(db)
+	for _, name := range members {
+		PublishUserRoles(db, name)
+	}
+	auditlog.Record(db, auditlog.AuditLog{
+		UserName: username,
+		Action:   "delete_role",
+		Target:   "role",
+		Metadata: map[string]string{
+			"id":      strconv.Itoa(del.ID),
+			"name":    target.Name,
+			"members": strconv.Itoa(len(members)),
+		},
+	})
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("Role Deleted\n"))
+}
+
+func AssignRole(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	var assign AssignRoleModel
+	if err := json.NewDecoder(r.Body).Decode(&assign); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	changeRole(w, r, db, assign.Username, assign.RoleID, true)
+}
+
+func UnassignRole(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	var unassign UnassignRoleModel
+	if err := json.NewDecoder(r.Body).Decode(&unassign); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	changeRole(w, r, db, unassign.Username, unassign.RoleID, false)
+}
+
+// changeRole gives (add) or takes roleID from target, doing it twice
+// changes nothing
+func changeRole(w http.ResponseWriter, r *http.Request, db *sqlx.DB, target string, roleID int, add bool) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+	if roleID == permissions.OWNER_ROLE {
+		http.Error(w, "The Owner role cannot be given or taken", http.StatusForbidden)
+		return
+	}
+	if roleID == permissions.MEMBER_ROLE {
+		http.Error(w, "Everybody has the Member role", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	caller, err := callerRole(tx, username)
+	if err != nil {
+		roleError(w, err)
+		return
+	}
+	callerRank := rank(caller.ID, caller.Position)
+
+	var role struct {
+		Name     string `db:"name"`
+		Position int    `db:"position"`
+	}
+	if err := tx.Get(&role, "SELECT name, position FROM roles WHERE id = ?", roleID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = errRoleNotFound
+		}
+		roleError(w, err)
+		return
+	}
+	current, err := callerRole(tx, target)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = errUserNotFound
+		}
+		roleError(w, err)
+		return
+	}
+	if rank(roleID, role.Position) >= callerRank || rank(current.ID, current.Position) >= callerRank {
+		roleError(w, errNotBelow)
+		return
+	}
+
+	var res sql.Result
+	if add {
+		res, err = tx.Exec(`
+			INSERT OR IGNORE INTO user_roles (user_id, role_id)
+			SELECT id, ? FROM users WHERE username = ?`, roleID, target)
+	} else {
+		res, err = tx.Exec(`
+			DELETE FROM user_roles
+			WHERE role_id = ? AND user_id = (SELECT id FROM users WHERE username = ?)`, roleID, target)
+	}
+	if err != nil {
+		roleError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		roleError(w, err)
+		return
+	}
+
+	action, message := "assign_role", "%s now has %s\n"
+	if !add {
+		action, message = "unassign_role", "%s no longer has %s\n"
+	}
+	if changed, _ := res.RowsAffected(); changed > 0 {
+		PublishUserRoles(db, target)
+		auditlog.Record(db, auditlog.AuditLog{
+			UserName: username,
+			Action:   action,
+			Target:   "user",
+			Metadata: map[string]string{
+				"username": target,
+				"role_id":  strconv.Itoa(roleID),
+				"role":     role.Name,
+			},
+		})
+	}
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf(message, target, role.Name)))
+}
+
+// UserRoles returns the roles of each user, highest first
+func UserRoles(q sqlx.Queryer, userIDs ...int) (map[int]MemberRoles, error) {
+	roles := map[int]MemberRoles{}
+	if len(userIDs) == 0 {
+		return roles, nil
+	}
+	query, args, err := sqlx.In(`
+		SELECT ur.user_id, r.id, r.name, r.color
+		FROM user_roles ur
+		JOIN roles r ON ur.role_id = r.id
+		WHERE ur.user_id IN (?)
+		ORDER BY ur.user_id, `+rankOrder, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		UserID int    `db:"user_id"`
+		ID     int    `db:"id"`
+		Name   string `db:"name"`
+		Color  string `db:"color"`
+	}
+	if err := sqlx.Select(q, &rows, query, args...); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		member, seen := roles[row.UserID]
+		if !seen {
+			member = MemberRoles{IDs: []int{}, TopID: row.ID, Top: row.Name}
+		}
+		member.IDs = append(member.IDs, row.ID)
+		if member.Color == "" {
+			member.Color = row.Color
+		}
+		roles[row.UserID] = member
+	}
+	return roles, nil
+}
+
+// PublishUserRoles sends the roles of username after they changed
+func PublishUserRoles(db *sqlx.DB, username string) {
+	var id int
+	if err := db.Get(&id, "SELECT id FROM users WHERE username = ?", username); err != nil {
+		log.Println(err)
+		return
+	}
+	roles, err := UserRoles(db, id)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	member := roles[id]
+	events.PublishUserUpdate(db, events.UserUpdate{
+		Username: username,
+		Role:     &member.Top,
+		Roles:    &member.IDs,
+		Color:    &member.Color,
+	})
+}
+
+// roleList is every role from the top, Owner first
+func roleList(db *sqlx.DB) ([]RoleResponse, error) {
+	list := []RoleResponse{}
+	err := db.Select(&list, roleSelect+" ORDER BY "+rankOrder)
+	return list, err
+}
+
+func publishRoles(db *sqlx.DB) {
+	list, err := roleList(db)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	events.Publish(db, events.ROLES_UPDATE, list)
+}
@@ -4,6 +4,13 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"pingless/internal/permissions"
+	"pingless/routes/chat"
+	"pingless/routes/dm"
+	"pingless/routes/emoji"
+	"pingless/routes/gateway"
+	"pingless/routes/invite"
+	"pingless/routes/role"
 	serversetup "pingless/routes/server_setup"
 	"pingless/routes/user"
 	"strconv"
@@ -41,52 +48,283 @@ func Routes(db *sqlx.DB) {
 	r.Post("/api/user/verify_user", func(w http.ResponseWriter, r *http.Request) {
 		user.VerifyUser(w, r, db)
 	})
+	r.Post("/api/user/refresh", func(w http.ResponseWriter, r *http.Request) {
+		user.RefreshToken(w, r, db)
+	})
+	r.Post("/api/user/forgot_password", func(w http.ResponseWriter, r *http.Request) {
+		user.ForgotPassword(w, r, db)
+	})
+	r.Post("/api/user/reset_password", func(w http.ResponseWriter, r *http.Request) {
+		user.ResetPassword(w, r, db)
+	})
+	r.Get("/api/user/oidc/login", func(w http.ResponseWriter, r *http.Request) {
+		user.OidcLogin(w, r, db)
+	})
+	r.Get("/api/user/oidc/callback", func(w http.ResponseWriter, r *http.Request) {
+		user.OidcCallback(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db)).Post("/api/user/oidc/link", func(w http.ResponseWriter, r *http.Request) {
+		user.OidcLink(w, r, db)
+	})
+	r.Post("/api/user/verify_mfa", func(w http.ResponseWriter, r *http.Request) {
+		user.VerifyMfa(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db)).Post("/api/user/2fa/enroll", func(w http.ResponseWriter, r *http.Request) {
+		user.EnrollMfa(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db)).Post("/api/user/2fa/confirm", func(w http.ResponseWriter, r *http.Request) {
+		user.ConfirmMfa(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db)).Post("/api/user/2fa/disable", func(w http.ResponseWriter, r *http.Request) {
+		user.DisableMfa(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db)).Post("/api/user/2fa/recovery_codes", func(w http.ResponseWriter, r *http.Request) {
+		user.RegenerateRecoveryCodes(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db)).Get("/api/user/sessions", func(w http.ResponseWriter, r *http.Request) {
+		user.ListSessions(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db)).Post("/api/user/sessions/revoke", func(w http.ResponseWriter, r *http.Request) {
+		user.RevokeSession(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db)).Post("/api/user/sessions/revoke_others", func(w http.ResponseWriter, r *http.Request) {
+		user.RevokeOtherSessions(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db)).Post("/api/user/tokens/create", func(w http.ResponseWriter, r *http.Request) {
+		user.CreatePersonalAccessToken(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db)).Get("/api/user/tokens", func(w http.ResponseWriter, r *http.Request) {
+		user.ListPersonalAccessTokens(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db)).Post("/api/user/tokens/revoke", func(w http.ResponseWriter, r *http.Request) {
+		user.RevokePersonalAccessToken(w, r, db)
+	})
 	r.Post("/api/server/create_owner", func(w http.ResponseWriter, r *http.Request) {
 		serversetup.CreateOwner(w, r, db)
 	})
-	r.With(user.VerifiyAccessToken).Post("/api/user/upload_pfp", func(w http.ResponseWriter, r *http.Request) {
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_PROFILE_WRITE)).Post("/api/user/upload_pfp", func(w http.ResponseWriter, r *http.Request) {
 		user.UpdatePfp(w, r, db)
 	})
-	r.With(user.VerifiyAccessToken).With(user.IsGifAllowed(db)).Post("/api/user/upload_pfp_gif", func(w http.ResponseWriter, r *http.Request) {
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_PROFILE_WRITE)).With(user.IsGifAllowed(db)).Post("/api/user/upload_pfp_gif", func(w http.ResponseWriter, r *http.Request) {
 		user.UpdatePfpGif(w, r, db)
 	})
-	r.With(user.VerifiyAccessToken).Post("/api/user/upload_banner", func(w http.ResponseWriter, r *http.Request) {
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_PROFILE_WRITE)).Post("/api/user/upload_banner", func(w http.ResponseWriter, r *http.Request) {
 		user.UpdateBanner(w, r, db)
 	})
-	r.With(user.VerifiyAccessToken).With(user.IsGifAllowed(db)).Post("/api/user/upload_banner_gif", func(w http.ResponseWriter, r *http.Request) {
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_PROFILE_WRITE)).With(user.IsGifAllowed(db)).Post("/api/user/upload_banner_gif", func(w http.ResponseWriter, r *http.Request) {
 		user.UpdateBannerGif(w, r, db)
 	})
-	r.With(user.VerifiyAccessToken).Post("/api/user/upload_bio", func(w http.ResponseWriter, r *http.Request) {
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_PROFILE_WRITE)).Post("/api/user/upload_bio", func(w http.ResponseWriter, r *http.Request) {
 		user.UpdateBio(w, r, db)
 	})
-	r.With(user.IsInviteOnly(db)).Post("/api/user/create_user", func(w http.ResponseWriter, r *http.Request) {
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_PROFILE_WRITE)).Post("/api/user/presence/heartbeat", func(w http.ResponseWriter, r *http.Request) {
+		user.PresenceHeartbeat(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_PROFILE_WRITE)).Post("/api/user/custom_status", func(w http.ResponseWriter, r *http.Request) {
+		user.SetCustomStatus(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_PROFILE_READ)).Get("/api/user/presence", func(w http.ResponseWriter, r *http.Request) {
+		user.GetPresence(w, r, db)
+	})
+	r.Post("/api/user/create_user", func(w http.ResponseWriter, r *http.Request) {
 		user.CreateUser(w, r, db)
 	})
-	r.With(user.VerifiyAccessToken).Post("/api/user/change_password", func(w http.ResponseWriter, r *http.Request) {
+	r.With(user.VerifiyAccessToken(db)).Post("/api/user/change_password", func(w http.ResponseWriter, r *http.Request) {
 		user.ChangePassword(w, r, db)
 	})
-	r.With(user.VerifiyAccessToken).With(serversetup.CanchangeServerSettings(db)).Post("/api/server/change_name", func(w http.ResponseWriter, r *http.Request) {
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_SERVER_SETTINGS)).With(user.RequirePermission(db, permissions.SERVER_SETTINGS)).Post("/api/server/change_name", func(w http.ResponseWriter, r *http.Request) {
 		serversetup.SetServerName(w, r, db)
 	})
-	r.With(user.VerifiyAccessToken).With(serversetup.CanchangeServerSettings(db)).Post("/api/server/change_profile", func(w http.ResponseWriter, r *http.Request) {
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_SERVER_SETTINGS)).With(user.RequirePermission(db, permissions.SERVER_SETTINGS)).Post("/api/server/change_profile", func(w http.ResponseWriter, r *http.Request) {
 		serversetup.SetServerProfile(w, r, db)
 	})
-	r.With(user.VerifiyAccessToken).With(serversetup.CanchangeServerSettings(db)).Post("/api/server/change_profile_gif", func(w http.ResponseWriter, r *http.Request) {
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_SERVER_SETTINGS)).With(user.RequirePermission(db, permissions.SERVER_SETTINGS)).Post("/api/server/change_profile_gif", func(w http.ResponseWriter, r *http.Request) {
 		serversetup.SetServerProfileGif(w, r, db)
 	})
-	r.With(user.VerifiyAccessToken).With(serversetup.CanchangeServerSettings(db)).Post("/api/server/change_banner", func(w http.ResponseWriter, r *http.Request) {
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_SERVER_SETTINGS)).With(user.RequirePermission(db, permissions.SERVER_SETTINGS)).Post("/api/server/change_banner", func(w http.ResponseWriter, r *http.Request) {
 		serversetup.SetServerBanner(w, r, db)
 	})
-	r.With(user.VerifiyAccessToken).With(serversetup.CanchangeServerSettings(db)).Post("/api/server/change_banner_gif", func(w http.ResponseWriter, r *http.Request) {
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_SERVER_SETTINGS)).With(user.RequirePermission(db, permissions.SERVER_SETTINGS)).Post("/api/server/change_banner_gif", func(w http.ResponseWriter, r *http.Request) {
 		serversetup.SetServerBannerGif(w, r, db)
 	})
-	r.Get("/api/user/images", func(w http.ResponseWriter, r *http.Request) {
+	r.With(user.VerifiyAccessToken(db)).With(user.RequirePermission(db, permissions.SERVER_SETTINGS)).Post("/api/server/require_2fa", func(w http.ResponseWriter, r *http.Request) {
+		serversetup.SetRequireMfa(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db)).With(user.RequirePermission(db, permissions.SERVER_SETTINGS)).Post("/api/server/rotate_signing_key", func(w http.ResponseWriter, r *http.Request) {
+		serversetup.RotateSigningKey(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db)).With(user.RequirePermission(db, permissions.SERVER_SETTINGS)).Post("/api/server/transfer_ownership", func(w http.ResponseWriter, r *http.Request) {
+		serversetup.TransferOwnership(w, r, db)
+	})
+	r.Get("/.well-known/jwks.json", func(w http.ResponseWriter, r *http.Request) {
+		serversetup.Jwks(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_INVITES)).With(user.RequirePermission(db, permissions.CREATE_INVITE)).Post("/api/invite/create", func(w http.ResponseWriter, r *http.Request) {
+		invite.CreateInvite(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_INVITES)).With(user.RequirePermission(db, permissions.CREATE_INVITE)).Get("/api/invite/list", func(w http.ResponseWriter, r *http.Request) {
+		invite.ListInvites(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_INVITES)).With(user.RequirePermission(db, permissions.CREATE_INVITE)).Post("/api/invite/revoke", func(w http.ResponseWriter, r *http.Request) {
+		invite.RevokeInvite(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_MESSAGES_READ)).Get("/api/channel/list", func(w http.ResponseWriter, r *http.Request) {
+		chat.ListChannels(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db)).With(user.RequirePermission(db, permissions.MANAGE_CHANNELS)).Post("/api/category/create", func(w http.ResponseWriter, r *http.Request) {
+		chat.CreateCategory(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db)).With(user.RequirePermission(db, permissions.MANAGE_CHANNELS)).Post("/api/category/rename", func(w http.ResponseWriter, r *http.Request) {
+		chat.RenameCategory(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db)).With(user.RequirePermission(db, permissions.MANAGE_CHANNELS)).Post("/api/category/reorder", func(w http.ResponseWriter, r *http.Request) {
+		chat.ReorderCategories(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db)).With(user.RequirePermission(db, permissions.MANAGE_CHANNELS)).Post("/api/category/delete", func(w http.ResponseWriter, r *http.Request) {
+		chat.DeleteCategory(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db)).With(user.RequirePermission(db, permissions.MANAGE_CHANNELS)).Post("/api/channel/create", func(w http.ResponseWriter, r *http.Request) {
+		chat.CreateChannel(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db)).With(user.RequirePermission(db, permissions.MANAGE_CHANNELS)).Post("/api/channel/rename", func(w http.ResponseWriter, r *http.Request) {
+		chat.RenameChannel(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db)).With(user.RequirePermission(db, permissions.MANAGE_CHANNELS)).Post("/api/channel/reorder", func(w http.ResponseWriter, r *http.Request) {
+		chat.ReorderChannels(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db)).With(user.RequirePermission(db, permissions.MANAGE_CHANNELS)).Post("/api/channel/delete", func(w http.ResponseWriter, r *http.Request) {
+		chat.DeleteChannel(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db)).With(user.RequirePermission(db, permissions.MANAGE_CHANNELS)).Get("/api/channel/overwrites", func(w http.ResponseWriter, r *http.Request) {
+		chat.ListOverwrites(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db)).With(user.RequirePermission(db, permissions.MANAGE_CHANNELS)).Post("/api/channel/overwrites/set", func(w http.ResponseWriter, r *http.Request) {
+		chat.SetOverwrite(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db)).With(user.RequirePermission(db, permissions.MANAGE_CHANNELS)).Post("/api/channel/overwrites/delete", func(w http.ResponseWriter, r *http.Request) {
+		chat.DeleteOverwrite(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_MESSAGES_READ)).Get("/api/message/history", func(w http.ResponseWriter, r *http.Request) {
+		chat.MessageHistory(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_MESSAGES_WRITE)).Post("/api/message/send", func(w http.ResponseWriter, r *http.Request) {
+		chat.SendMessage(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_MESSAGES_WRITE)).Post("/api/message/edit", func(w http.ResponseWriter, r *http.Request) {
+		chat.EditMessage(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_MESSAGES_WRITE)).Post("/api/message/delete", func(w http.ResponseWriter, r *http.Request) {
+		chat.DeleteMessage(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_MESSAGES_WRITE)).Post("/api/dm/open", func(w http.ResponseWriter, r *http.Request) {
+		dm.OpenConversation(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_MESSAGES_READ)).Get("/api/dm/list", func(w http.ResponseWriter, r *http.Request) {
+		dm.ListConversations(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_MESSAGES_READ)).Get("/api/dm/history", func(w http.ResponseWriter, r *http.Request) {
+		dm.MessageHistory(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_MESSAGES_WRITE)).Post("/api/dm/send", func(w http.ResponseWriter, r *http.Request) {
+		dm.SendMessage(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_MESSAGES_WRITE)).Post("/api/dm/edit", func(w http.ResponseWriter, r *http.Request) {
+		dm.EditMessage(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_MESSAGES_WRITE)).Post("/api/dm/delete", func(w http.ResponseWriter, r *http.Request) {
+		dm.DeleteMessage(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_PROFILE_WRITE)).Post("/api/friends/request", func(w http.ResponseWriter, r *http.Request) {
+		user.SendFriendRequest(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_PROFILE_WRITE)).Post("/api/friends/accept", func(w http.ResponseWriter, r *http.Request) {
+		user.AcceptFriendRequest(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_PROFILE_WRITE)).Post("/api/friends/decline", func(w http.ResponseWriter, r *http.Request) {
+		user.DeclineFriendRequest(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_PROFILE_WRITE)).Post("/api/friends/cancel", func(w http.ResponseWriter, r *http.Request) {
+		user.CancelFriendRequest(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_PROFILE_WRITE)).Post("/api/friends/remove", func(w http.ResponseWriter, r *http.Request) {
+		user.RemoveFriend(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_PROFILE_READ)).Get("/api/friends/list", func(w http.ResponseWriter, r *http.Request) {
+		user.ListFriends(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_PROFILE_READ)).Get("/api/friends/pending", func(w http.ResponseWriter, r *http.Request) {
+		user.ListFriendRequests(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_PROFILE_WRITE)).Post("/api/user/block", func(w http.ResponseWriter, r *http.Request) {
+		user.BlockUser(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_PROFILE_WRITE)).Post("/api/user/unblock", func(w http.ResponseWriter, r *http.Request) {
+		user.UnblockUser(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_PROFILE_READ)).Get("/api/user/blocks", func(w http.ResponseWriter, r *http.Request) {
+		user.ListBlocks(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_PROFILE_READ)).Get("/api/user/profile", func(w http.ResponseWriter, r *http.Request) {
+		user.GetProfile(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_PROFILE_READ)).Get("/api/user/profile/me", func(w http.ResponseWriter, r *http.Request) {
+		user.GetMe(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_SERVER_SETTINGS)).With(user.RequirePermission(db, permissions.MANAGE_EMOJIS)).Post("/api/emoji/upload", func(w http.ResponseWriter, r *http.Request) {
+		emoji.UploadEmoji(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_SERVER_SETTINGS)).With(user.RequirePermission(db, permissions.MANAGE_EMOJIS)).With(user.IsGifAllowed(db)).Post("/api/emoji/upload_gif", func(w http.ResponseWriter, r *http.Request) {
+		emoji.UploadEmojiGif(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_SERVER_SETTINGS)).With(user.RequirePermission(db, permissions.MANAGE_EMOJIS)).Post("/api/emoji/rename", func(w http.ResponseWriter, r *http.Request) {
+		emoji.RenameEmoji(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_SERVER_SETTINGS)).With(user.RequirePermission(db, permissions.MANAGE_EMOJIS)).Post("/api/emoji/delete", func(w http.ResponseWriter, r *http.Request) {
+		emoji.DeleteEmoji(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_MESSAGES_READ)).Get("/api/emoji/list", func(w http.ResponseWriter, r *http.Request) {
+		emoji.ListEmojis(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_PROFILE_READ)).Get("/api/members", func(w http.ResponseWriter, r *http.Request) {
+		user.ListMembers(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_PROFILE_WRITE)).Post("/api/user/profile/update", func(w http.ResponseWriter, r *http.Request) {
+		user.UpdateProfile(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_PROFILE_WRITE)).Post("/api/user/profile/verify_links", func(w http.ResponseWriter, r *http.Request) {
+		user.VerifyLinks(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_PROFILE_READ)).Get("/api/roles/list", func(w http.ResponseWriter, r *http.Request) {
+		role.ListRoles(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_SERVER_SETTINGS)).With(user.RequirePermission(db, permissions.MANAGE_ROLES)).Post("/api/roles/create", func(w http.ResponseWriter, r *http.Request) {
+		role.CreateRole(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_SERVER_SETTINGS)).With(user.RequirePermission(db, permissions.MANAGE_ROLES)).Post("/api/roles/update", func(w http.ResponseWriter, r *http.Request) {
+		role.UpdateRole(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_SERVER_SETTINGS)).With(user.RequirePermission(db, permissions.MANAGE_ROLES)).Post("/api/roles/delete", func(w http.ResponseWriter, r *http.Request) {
+		role.DeleteRole(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_SERVER_SETTINGS)).With(user.RequirePermission(db, permissions.MANAGE_ROLES)).Post("/api/roles/assign", func(w http.ResponseWriter, r *http.Request) {
+		role.AssignRole(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_SERVER_SETTINGS)).With(user.RequirePermission(db, permissions.MANAGE_ROLES)).Post("/api/roles/unassign", func(w http.ResponseWriter, r *http.Request) {
+		role.UnassignRole(w, r, db)
+	})
+	r.Get("/api/gateway", func(w http.ResponseWriter, r *http.Request) {
+		gateway.Gateway(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_MESSAGES_READ)).Get("/api/events", func(w http.ResponseWriter, r *http.Request) {
+		gateway.Events(w, r, db)
+	})
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_PROFILE_READ)).Get("/api/user/images", func(w http.ResponseWriter, r *http.Request) {
 		user.GetUserImages(w, r, db)
 	})
-	r.Get("/api/images/info", func(w http.ResponseWriter, r *http.Request) {
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_PROFILE_READ)).Get("/api/images/info", func(w http.ResponseWriter, r *http.Request) {
 		user.GetImageInfo(w, r, db)
 	})
-	r.Get("/api/user/image", func(w http.ResponseWriter, r *http.Request) {
+	r.With(user.VerifiyAccessToken(db, user.SCOPE_PROFILE_READ)).Get("/api/user/image", func(w http.ResponseWriter, r *http.Request) {
 		user.GetUserImageByType(w, r, db)
 	})
 
@@ -3,3 +3,12 @@ package serversetup
 type SetServerNameStruct struct {
 	ServerName string `db:"name" json:"name"`
 }
+
+type RequireMfaStruct struct {
+	Enabled bool `json:"enabled"`
+}
+
+type TransferOwnershipModel struct {
+	Username string `json:"username"` // new owner
+	Password string `json:"password"` // of the current owner
+}
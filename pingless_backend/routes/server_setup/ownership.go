@@ -0,0 +1,189 @@
+package serversetup
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"pingless/internal/auditlog"
+	"pingless/internal/permissions"
+	"pingless/routes/role"
+	"pingless/routes/user"
+	"strconv"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*
+NOTE : This file deal with handing the server to another user
+
+Only the owner can do it, with their password. In one transaction the
+target gets the Owner role and the old owner loses it for the role named by
+OWNER_TRANSFER_ROLE (Member when unset or unknown). Both are told by email,
+a failed email does not undo the transfer.
+*/
+
+const ownershipSubject = "Pingless server ownership transferred"
+
+func TransferOwnership(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var transfer TransferOwnershipModel
+	if err := json.NewDecoder(r.Body).Decode(&transfer); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if transfer.Username == username {
+		http.Error(w, "You already own the server", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var owner struct {
+		ID       int    `db:"id"`
+		Email    string `db:"email"`
+		Password string `db:"password_hash"`
+		IsOwner  bool   `db:"is_owner"`
+	}
+	err = tx.Get(&owner, `
+		SELECT u.id, u.email, u.password_hash,
+			EXISTS(SELECT 1 FROM user_roles ur WHERE ur.user_id = u.id AND ur.role_id = ?) AS is_owner
+		FROM users u WHERE u.username = ?`, permissions.OWNER_ROLE, username)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if !owner.IsOwner {
+		http.Error(w, "Only the owner can transfer the server", http.StatusForbidden)
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(owner.Password), []byte(transfer.Password)); err != nil {
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	var target struct {
+		ID    int    `db:"id"`
+		Email string `db:"email"`
+	}
+	if err := tx.Get(&target, "SELECT id, email FROM users WHERE username = ?", transfer.Username); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	demoteTo, err := transferRole(tx)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	for _, stmt := range []struct {
+		query string
+		args  []any
+	}{
+		{"DELETE FROM user_roles WHERE user_id = ? AND role_id = ?", []any{owner.ID, permissions.OWNER_ROLE}},
+		{"INSERT OR IGNORE INTO user_roles (user_id, role_id) VALUES (?, ?)", []any{owner.ID, demoteTo.ID}},
+		{"INSERT OR IGNORE INTO user_roles (user_id, role_id) VALUES (?, ?)", []any{target.ID, permissions.OWNER_ROLE}},
+	} {
+		if _, err := tx.Exec(stmt.query, stmt.args...); err != nil {
+			log.Println(err)
+			http.Error(w, "DB ERROR", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	role.PublishUserRoles(db, username)
+	role.PublishUserRoles(db, transfer.Username)
+	auditlog.Record(db, auditlog.AuditLog{
+		UserName: username,
+		Action:   "transfer_ownership",
+		Target:   "server",
+		Metadata: map[string]string{
+			"new_owner":   transfer.Username,
+			"old_role_id": strconv.Itoa(demoteTo.ID),
+		},
+	})
+
+	notify(db, owner.Email, user.NoticeEmail(
+		"Pingless Ownership Transferred",
+		"You handed over your server",
+		fmt.Sprintf("%s now owns the server. You keep the %s role.", html.EscapeString(transfer.Username), html.EscapeString(demoteTo.Name)),
+		"You received this email because you owned this Pingless server.",
+	))
+	notify(db, target.Email, user.NoticeEmail(
+		"Pingless Ownership Transferred",
+		"You now own the server",
+		fmt.Sprintf("%s handed the server over to you. You have every permission.", html.EscapeString(username)),
+		"You received this email because the owner of this Pingless server chose you.",
+	))
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf("%s now owns the server\n", transfer.Username)))
+}
+
+// transferRole is the role of OWNER_TRANSFER_ROLE, Member when it names no
+// role or the Owner role
+func transferRole(tx *sqlx.Tx) (demoteRole, error) {
+	var name string
+	err := tx.Get(&name, "SELECT value FROM settings WHERE key = 'ownerTransferRole'")
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return demoteRole{}, err
+	}
+
+	var demote demoteRole
+	err = tx.Get(&demote, "SELECT id, name FROM roles WHERE name = ? AND id != ? ORDER BY id LIMIT 1", name, permissions.OWNER_ROLE)
+	if err == nil {
+		return demote, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return demoteRole{}, err
+	}
+	log.Printf("OWNER_TRANSFER_ROLE %q is not a role, using Member\n", name)
+	err = tx.Get(&demote, "SELECT id, name FROM roles WHERE id = ?", permissions.MEMBER_ROLE)
+	return demote, err
+}
+
+type demoteRole struct {
+	ID   int    `db:"id"`
+	Name string `db:"name"`
+}
+
+func notify(db *sqlx.DB, to string, body string) {
+	if err := user.SendEmail(db, to, ownershipSubject, body); err != nil {
+		log.Println(err)
+	}
+}
@@ -6,12 +6,16 @@ ADD LOG SUPPORT
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"pingless/internal/auditlog"
+	"pingless/internal/events"
 	"pingless/internal/fileutil"
+	"pingless/internal/permissions"
 	"pingless/routes/user"
 	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/jmoiron/sqlx"
@@ -21,63 +25,84 @@ import (
 const SERVER_NAME_LENGTH int = 200
 
 func CreateOwner(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
-	var user user.CreateUserModel
+	var owner user.CreateUserModel
 
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+	if err := json.NewDecoder(r.Body).Decode(&owner); err != nil {
 		log.Println(err)
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
 
-	// Check if user is verified
-	var verified bool
-	err := db.QueryRow("SELECT verified FROM email_verifications WHERE email = ?", user.Email).Scan(&verified)
+	tx, err := db.Beginx()
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "DB ERROR", http.StatusInternalServerError)
 		return
 	}
-	if !verified {
-		log.Println(err)
-		http.Error(w, "UNAUTHORIZED", http.StatusBadRequest)
-		return
-	}
+	defer tx.Rollback()
 
 	var exists bool
-	err = db.Get(&exists, `SELECT EXISTS(SELECT 1 FROM users WHERE role_id = 1)`)
+	err = tx.Get(&exists, `SELECT EXISTS(SELECT 1 FROM user_roles WHERE role_id = ?)`, permissions.OWNER_ROLE)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "DB ERROR", http.StatusInternalServerError)
 		return
 	}
 	if exists {
-		log.Println(err)
 		http.Error(w, "Owner already present", http.StatusBadRequest)
 		return
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+	if err := user.ConsumeRegistrationTicket(db, tx, owner.Ticket, owner.Email); err != nil {
+		if errors.Is(err, user.ErrInvalidTicket) {
+			http.Error(w, "Invalid or expired registration ticket", http.StatusUnauthorized)
+			return
+		}
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	// Only hashed once the ticket is good, a forged ticket costs no bcrypt
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(owner.Password), bcrypt.DefaultCost)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "Hash Error", http.StatusInternalServerError)
 		return
 	}
-	user.Password = string(hashedPassword)
-	if err := createOwnerQuery(db, &user); err != nil {
+	owner.Password = string(hashedPassword)
+
+	if err := createOwnerQuery(tx, &owner); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
 		log.Println(err)
 		http.Error(w, "DB ERROR", http.StatusInternalServerError)
 		return
 	}
 
+	events.Publish(db, events.USER_CREATE, events.UserCreate{Username: owner.Username, CreatedAt: time.Now()})
 	w.WriteHeader(http.StatusCreated)
 	w.Write([]byte("Owner Created\n"))
 }
 
-func createOwnerQuery(db *sqlx.DB, user *user.CreateUserModel) error {
-	_, err := db.Exec(`
-		INSERT INTO users (username, email, password_hash, role_id)
-		VALUES (?, ?, ?, 1)
-	`, user.Username, user.Email, user.Password)
+// The owner has Owner (1) and Member (2) like everybody
+func createOwnerQuery(db sqlx.Execer, owner *user.CreateUserModel) error {
+	res, err := db.Exec(`
+		INSERT INTO users (username, email, password_hash)
+		VALUES (?, ?, ?)
+	`, owner.Username, owner.Email, owner.Password)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO user_roles (user_id, role_id) VALUES (?, ?), (?, ?)",
+		id, permissions.OWNER_ROLE, id, permissions.MEMBER_ROLE)
 	return err
 }
 
@@ -134,6 +159,7 @@ func SetServerName(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
 			"new": server.ServerName,
 		},
 	})
+	events.Publish(db, events.SERVER_UPDATE, events.ServerUpdate{Name: server.ServerName})
 	w.WriteHeader(http.StatusAccepted)
 }
 
@@ -190,3 +216,59 @@ func SetServerBannerGif(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
 	)
 	fileutil.ServerFileUpload(w, r, db, config)
 }
+
+// SetRequireMfa turns on/off the 2FA requirement for every role that can
+// change server settings. It can only be enabled from a 2FA session, so the
+// owner cannot lock themselves out.
+func SetRequireMfa(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var require RequireMfaStruct
+	if err := json.NewDecoder(r.Body).Decode(&require); err != nil {
+		log.Println(err)
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if mfa, _ := claims["mfa"].(bool); require.Enabled && !mfa {
+		http.Error(w, "Enable two-factor authentication and log in with it first", http.StatusBadRequest)
+		return
+	}
+
+	value := "false"
+	if require.Enabled {
+		value = "true"
+	}
+	_, err := db.Exec(`
+		INSERT INTO settings (key, value)
+		VALUES ('requireMfaForAdmins', ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value
+	`, value)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	auditlog.Record(db, auditlog.AuditLog{
+		UserName: username,
+		Action:   "change_require_2fa",
+		Target:   "require_2fa",
+		Metadata: map[string]string{
+			"new": value,
+		},
+	})
+	events.Publish(db, events.SERVER_UPDATE, events.ServerUpdate{Require2fa: &require.Enabled})
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,77 @@
+package serversetup
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"pingless/internal/auditlog"
+	"pingless/internal/signing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+NOTE : This file deal with the keys that sign access tokens
+
+The public keys are published as a JWKS so other services can verify
+pingless tokens on their own.
+*/
+
+func Jwks(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	keys, err := signing.PublicKeys(db)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	// Short cache, a rotated key has to show up before tokens signed with it
+	// reach other services
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"keys": keys,
+	})
+}
+
+// RotateSigningKey makes a new key sign from now on, tokens signed with the
+// old key stay valid for signing.RETIRED_KEY_GRACE
+func RotateSigningKey(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	kid, err := signing.Rotate(db)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	auditlog.Record(db, auditlog.AuditLog{
+		UserName: username,
+		Action:   "rotate_signing_key",
+		Target:   "signing_key",
+		Metadata: map[string]string{
+			"kid": kid,
+		},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"kid":          kid,
+		"grace_period": int(signing.RETIRED_KEY_GRACE / time.Second),
+	})
+}
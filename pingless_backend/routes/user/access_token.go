@@ -0,0 +1,307 @@
+package user
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"pingless/internal/auditlog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+NOTE : This file deal with personal access tokens
+
+A personal access token ("plt_...") is a long lived bearer token for
+scripts. Only its sha256 is stored, like refresh tokens, the plain token is
+shown once on creation. A route accepts them only when it is registered with
+VerifiyAccessToken(db, scope) and the token has that scope, everything else
+(sessions, 2FA, passwords, token management) needs a real login.
+
+Changing or resetting the password revokes every token of the user.
+*/
+
+const (
+	PAT_PREFIX         = "plt_"
+	MAX_PATS_PER_USER  = 50
+	MAX_PAT_NAME_SIZE  = 100
+	MAX_PAT_LIFETIME   = 365 * 24 * time.Hour
+	PAT_SEEN_INTERVAL  = time.Minute
+	patDisplayedPrefix = 8
+)
+
+// Scopes a personal access token can be given
+const (
+	SCOPE_PROFILE_READ    = "profile:read"
+	SCOPE_PROFILE_WRITE   = "profile:write"
+	SCOPE_SERVER_SETTINGS = "server:settings"
+	SCOPE_INVITES         = "invites:manage"
+	SCOPE_MESSAGES_READ   = "messages:read"
+	SCOPE_MESSAGES_WRITE  = "messages:write"
+)
+
+var PAT_SCOPES = []string{SCOPE_PROFILE_READ, SCOPE_PROFILE_WRITE, SCOPE_SERVER_SETTINGS, SCOPE_INVITES, SCOPE_MESSAGES_READ, SCOPE_MESSAGES_WRITE}
+
+var errPatInvalid = errors.New("invalid personal access token")
+
+func isPersonalAccessToken(token string) bool {
+	return strings.HasPrefix(token, PAT_PREFIX)
+}
+
+// checkPersonalAccessToken returns the claims a PAT stands for. They look
+// like the claims of an access token, with "pat" set and no "sid".
+func checkPersonalAccessToken(db *sqlx.DB, token string) (jwt.MapClaims, error) {
+	var pat struct {
+		ID         int          `db:"id"`
+		Username   string       `db:"username"`
+		Scopes     string       `db:"scopes"`
+		Mfa        bool         `db:"mfa"`
+		Revoked    bool         `db:"revoked"`
+		ExpiresAt  sql.NullTime `db:"expires_at"`
+		LastUsedAt sql.NullTime `db:"last_used_at"`
+	}
+	err := db.Get(&pat, `
+		SELECT p.id, u.username, p.scopes, p.mfa, p.revoked, p.expires_at, p.last_used_at
+		FROM personal_access_tokens p
+		JOIN users u ON p.user_id = u.id
+		WHERE p.token_hash = ?`, hashToken(token))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errPatInvalid
+		}
+		return nil, err
+	}
+	now := time.Now()
+	if pat.Revoked || (pat.ExpiresAt.Valid && now.After(pat.ExpiresAt.Time)) {
+		return nil, errPatInvalid
+	}
+
+	if !pat.LastUsedAt.Valid || now.Sub(pat.LastUsedAt.Time) > PAT_SEEN_INTERVAL {
+		if _, err := db.Exec("UPDATE personal_access_tokens SET last_used_at = ? WHERE id = ?", now, pat.ID); err != nil {
+			log.Println(err)
+		}
+	}
+
+	scopes := []any{}
+	for _, scope := range strings.Split(pat.Scopes, ",") {
+		scopes = append(scopes, scope)
+	}
+	return jwt.MapClaims{
+		"username": pat.Username,
+		"pat":      true,
+		"pat_id":   pat.ID,
+		"scopes":   scopes,
+		"mfa":      pat.Mfa,
+	}, nil
+}
+
+// hasScope reports whether claims coming from a PAT carry scope
+func hasScope(claims jwt.MapClaims, scope string) bool {
+	scopes, _ := claims["scopes"].([]any)
+	return slices.Contains(scopes, any(scope))
+}
+
+func CreatePersonalAccessToken(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var create CreatePersonalAccessTokenModel
+	if err := json.NewDecoder(r.Body).Decode(&create); err != nil {
+		log.Println(err)
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	create.Name = strings.TrimSpace(create.Name)
+	if create.Name == "" || len(create.Name) > MAX_PAT_NAME_SIZE {
+		http.Error(w, "Name must be 1 to 100 characters", http.StatusBadRequest)
+		return
+	}
+	if len(create.Scopes) == 0 {
+		http.Error(w, "At least one scope is required", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range create.Scopes {
+		if !slices.Contains(PAT_SCOPES, scope) {
+			http.Error(w, "Unknown scope "+scope, http.StatusBadRequest)
+			return
+		}
+	}
+	slices.Sort(create.Scopes)
+	create.Scopes = slices.Compact(create.Scopes)
+	if create.ExpiresIn < 0 || time.Duration(create.ExpiresIn)*time.Second > MAX_PAT_LIFETIME {
+		http.Error(w, "Token can live at most 365 days", http.StatusBadRequest)
+		return
+	}
+
+	var userID int
+	if err := db.Get(&userID, "SELECT id FROM users WHERE username = ?", username); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	var count int
+	if err := db.Get(&count, "SELECT COUNT(*) FROM personal_access_tokens WHERE user_id = ? AND revoked = FALSE", userID); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if count >= MAX_PATS_PER_USER {
+		http.Error(w, "Too many tokens, revoke some first", http.StatusBadRequest)
+		return
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Token Error", http.StatusInternalServerError)
+		return
+	}
+	token := PAT_PREFIX + secret
+
+	now := time.Now()
+	var expiresAt *time.Time
+	if create.ExpiresIn > 0 {
+		t := now.Add(time.Duration(create.ExpiresIn) * time.Second)
+		expiresAt = &t
+	}
+	// A token made from a 2FA session counts as 2FA for require_2fa
+	mfa, _ := claims["mfa"].(bool)
+
+	res, err := db.Exec(`
+		INSERT INTO personal_access_tokens (user_id, name, token_hash, token_prefix, scopes, mfa, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		userID, create.Name, hashToken(token), token[:len(PAT_PREFIX)+patDisplayedPrefix],
+		strings.Join(create.Scopes, ","), mfa, expiresAt, now,
+	)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	id, _ := res.LastInsertId()
+
+	auditlog.Record(db, auditlog.AuditLog{
+		UserName: username,
+		Action:   "create_access_token",
+		Target:   "personal_access_token",
+		Metadata: map[string]string{
+			"id":     strconv.FormatInt(id, 10),
+			"name":   create.Name,
+			"scopes": strings.Join(create.Scopes, ","),
+		},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"id":         id,
+		"name":       create.Name,
+		"token":      token,
+		"scopes":     create.Scopes,
+		"expires_at": expiresAt,
+	})
+}
+
+func ListPersonalAccessTokens(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	tokens := []PersonalAccessTokenResponse{}
+	err := db.Select(&tokens, `
+		SELECT p.id, p.name, p.token_prefix, p.scopes, p.expires_at, p.last_used_at, p.created_at
+		FROM personal_access_tokens p
+		JOIN users u ON p.user_id = u.id
+		WHERE u.username = ? AND p.revoked = FALSE
+		ORDER BY p.created_at DESC`, username)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	for i := range tokens {
+		tokens[i].Scopes = strings.Split(tokens[i].ScopeList, ",")
+		tokens[i].Expired = tokens[i].ExpiresAt != nil && time.Now().After(*tokens[i].ExpiresAt)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func RevokePersonalAccessToken(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var revoke RevokePersonalAccessTokenModel
+	if err := json.NewDecoder(r.Body).Decode(&revoke); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	res, err := db.Exec(`
+		UPDATE personal_access_tokens SET revoked = TRUE
+		WHERE id = ? AND revoked = FALSE AND user_id = (SELECT id FROM users WHERE username = ?)`,
+		revoke.ID, username)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+
+	auditlog.Record(db, auditlog.AuditLog{
+		UserName: username,
+		Action:   "revoke_access_token",
+		Target:   "personal_access_token",
+		Metadata: map[string]string{
+			"id": strconv.Itoa(revoke.ID),
+		},
+	})
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("Token Revoked\n"))
+}
+
+func revokeUserAccessTokens(db sqlx.Execer, userID int) error {
+	_, err := db.Exec("UPDATE personal_access_tokens SET revoked = TRUE WHERE user_id = ?", userID)
+	return err
+}
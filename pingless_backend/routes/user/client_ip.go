@@ -0,0 +1,90 @@
+package user
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+/*
+NOTE : This file deal with finding the address of the client
+
+The backend can be reached directly as well as through nginx, so the
+X-Real-IP and X-Forwarded-For headers are only believed when the peer is
+one of the proxies listed in TRUSTED_PROXIES. Anyone else could set them to
+whatever they like.
+*/
+
+var trustedProxies []*net.IPNet
+
+// SetTrustedProxies takes the comma separated TRUSTED_PROXIES list, CIDRs
+// or single addresses
+func SetTrustedProxies(list string) error {
+	var proxies []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		proxies = append(proxies, network)
+	}
+	trustedProxies = proxies
+	return nil
+}
+
+// clientIP is the peer address, or the address a trusted proxy says it is
+// forwarding for
+func clientIP(r *http.Request) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	if !isTrustedProxy(peer) {
+		return peer
+	}
+
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	// The right most entry not added by one of our proxies is the client
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			break
+		}
+		if !isTrustedProxy(ip.String()) {
+			return ip.String()
+		}
+	}
+	return peer
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -24,7 +24,11 @@ TODO:
  [ ] Add option for custom email template
 */
 
-// TODO : dont send email if already Verified
+// Wrong guesses allowed before an otp is invalidated
+const OTP_MAX_ATTEMPTS = 5
+
+// Email sends the otp that verifies an email before registering. Emails
+// that already belong to a user are refused.
 func Email(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
 	var email EmailSend
 
@@ -35,11 +39,21 @@ func Email(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
 	}
 	defer r.Body.Close()
 
-	verified, created_at, exist, error := checkEmailExist(db, email.Email)
-	if verified {
-		http.Error(w, "BAD REQUEST", http.StatusBadRequest)
+	registered, err := isEmailRegistered(db, email.Email)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if registered {
+		http.Error(w, "Email already registered", http.StatusBadRequest)
 		return
 	}
+
+	verified, created_at, exist, error := checkEmailExist(db, email.Email)
+	// Verified but never registered, e.g. the ticket expired. It is
+	// verified again like a pending one.
+	exist = exist || verified
 	if error != nil {
 		log.Println(error)
 		http.Error(w, "DB ERROR", http.StatusInternalServerError)
@@ -59,7 +73,7 @@ func Email(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
 			http.Error(w, "DB ERROR", http.StatusInternalServerError)
 			return
 		}
-		if err := sendEmail(db, email.Email, hashOtp); err != nil {
+		if err := SendEmail(db, email.Email, verificationSubject, verificationEmail(otp)); err != nil {
 			log.Println(err)
 			http.Error(w, "Verification email Cannot Be Send", http.StatusInternalServerError)
 			return
@@ -78,7 +92,7 @@ func Email(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
 			http.Error(w, "Database Error", http.StatusInternalServerError)
 			return
 		}
-		if err := sendEmail(db, email.Email, otp); err != nil {
+		if err := SendEmail(db, email.Email, verificationSubject, verificationEmail(otp)); err != nil {
 			log.Println(err)
 			http.Error(w, "Verification email Cannot Be Send", http.StatusInternalServerError)
 			return
@@ -111,7 +125,9 @@ func UpdateCreatedAt(db *sqlx.DB, email string, hashOtp string) error {
 	_, err := db.Exec(`
 		UPDATE email_verifications
 		SET created_at = ?,
-		otp_hash = ?
+		otp_hash = ?,
+		attempts = 0,
+		verified = FALSE
 		WHERE email = ?`,
 		time.Now(), hashOtp, email,
 	)
@@ -127,10 +143,16 @@ func OtpVerify(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
+	emailKey := throttleKey("email", otp.Email)
+	if rejectIfLocked(w, db, emailKey, throttleKey("ip", clientIP(r))) {
+		return
+	}
+
 	var hashedOrignalOtp string
 	var created_at time.Time
 	var verified bool
-	err := db.QueryRow("SELECT otp_hash,created_at,verified FROM email_verifications WHERE email = ? ", otp.Email).Scan(&hashedOrignalOtp, &created_at, &verified)
+	var attempts int
+	err := db.QueryRow("SELECT otp_hash,created_at,verified,attempts FROM email_verifications WHERE email = ? ", otp.Email).Scan(&hashedOrignalOtp, &created_at, &verified, &attempts)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "Database Error", http.StatusInternalServerError)
@@ -140,12 +162,26 @@ func OtpVerify(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
 		http.Error(w, "BAD REQUEST", http.StatusBadRequest)
 		return
 	}
+	if attempts >= OTP_MAX_ATTEMPTS {
+		http.Error(w, "Too many wrong codes, request a new one", http.StatusBadRequest)
+		return
+	}
 	hashedUserOtp := HashOTP(otp.Otp)
 	if hashedOrignalOtp != hashedUserOtp || time.Now().After(created_at.Add(10*time.Minute)) {
-		log.Println(err)
+		// The otp is thrown away after OTP_MAX_ATTEMPTS wrong guesses
+		_, err := db.Exec(`
+			UPDATE email_verifications
+			SET attempts = attempts + 1,
+			otp_hash = CASE WHEN attempts + 1 >= ? THEN '' ELSE otp_hash END
+			WHERE email = ?`, OTP_MAX_ATTEMPTS, otp.Email)
+		if err != nil {
+			log.Println(err)
+		}
+		recordFailures(db, r, emailKey, otp.Email)
 		http.Error(w, "Unauthorized", http.StatusBadRequest)
 		return
 	}
+	clearFailures(db, emailKey)
 
 	_, err = db.Exec("UPDATE email_verifications SET verified = TRUE where email =  ?", otp.Email)
 	if err != nil {
@@ -154,8 +190,20 @@ func OtpVerify(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
 		return
 	}
 
+	// Only the one who completed the otp can register with this email
+	ticket, err := issueRegistrationTicket(db, otp.Email)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Database Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusAccepted)
-	w.Write([]byte("Verified\n"))
+	json.NewEncoder(w).Encode(map[string]any{
+		"registration_ticket": ticket,
+		"expires_in":          int(REGISTRATION_TICKET_TTL.Seconds()),
+	})
 }
 
 func HashOTP(otp string) string {
@@ -173,7 +221,8 @@ func insertEmailVerification(db *sqlx.DB, verify *EmailVerification) error {
 	return err
 }
 
-func sendEmail(db *sqlx.DB, to string, otp string) error {
+// SendEmail sends html with the SMTP settings of the server
+func SendEmail(db *sqlx.DB, to string, subject string, html string) error {
 	var from string
 	var password string
 	var host string
@@ -197,25 +246,58 @@ func sendEmail(db *sqlx.DB, to string, otp string) error {
 		return err
 	}
 
-	subject := "Your Pingless Verification Code"
-
 	msg := fmt.Sprintf(`Subject: %s
 MIME-Version: 1.0
 Content-Type: text/html; charset="UTF-8"
 
-<!DOCTYPE html>
+%s`, subject, html)
+
+	body := []byte(msg)
+
+	auth := smtp.PlainAuth("", from, password, host)
+
+	err = smtp.SendMail(host+":"+port, auth, from, []string{to}, body)
+	return err
+}
+
+const verificationSubject = "Your Pingless Verification Code"
+
+func verificationEmail(otp string) string {
+	return otpEmail(
+		"Pingless Email Verification",
+		"Verify your email with Pingless",
+		"Use the code below to verify your email address. This code will expire in 10 minutes.",
+		otp,
+		"You received this email because someone tried to sign up with your address.",
+	)
+}
+
+const passwordResetSubject = "Your Pingless Password Reset Code"
+
+func passwordResetEmail(otp string) string {
+	return otpEmail(
+		"Pingless Password Reset",
+		"Reset your Pingless password",
+		"Use the code below to choose a new password. This code will expire in 15 minutes.",
+		otp,
+		"You received this email because someone asked to reset the password of your account.",
+	)
+}
+
+func otpEmail(title string, heading string, text string, otp string, reason string) string {
+	return fmt.Sprintf(`<!DOCTYPE html>
 <html>
 <head>
   <meta charset="UTF-8">
-  <title>Pingless Email Verification</title>
+  <title>%s</title>
 </head>
 <body style="font-family: Arial, sans-serif; background-color: #f9fafb; margin: 0; padding: 0;">
   <div style="background-color: #ffffff; max-width: 480px; margin: 40px auto; padding: 32px; border-radius: 8px; box-shadow: 0 2px 8px rgba(0,0,0,0.05);">
     <div style="font-size: 20px; font-weight: 600; color: #111827; margin-bottom: 24px;">
-      Verify your email with Pingless
+      %s
     </div>
     <div style="font-size: 14px; color: #4b5563;">
-      Use the code below to verify your email address. This code will expire in 10 minutes.
+      %s
     </div>
     <div style="font-size: 32px; letter-spacing: 4px; font-weight: bold; color: #111827; background-color: #f3f4f6; padding: 16px; text-align: center; border-radius: 6px; margin: 24px 0;">
       %s
@@ -225,17 +307,37 @@ Content-Type: text/html; charset="UTF-8"
     </div>
     <div style="font-size: 12px; color: #9ca3af; text-align: center; margin-top: 32px;">
       Pingless · A self-hosted async status board<br>
-      You received this email because someone tried to sign up with your address.
+      %s
     </div>
   </div>
 </body>
 </html>
-`, subject, otp)
-
-	body := []byte(msg)
-
-	auth := smtp.PlainAuth("", from, password, host)
+`, title, heading, text, otp, reason)
+}
 
-	err = smtp.SendMail(host+":"+port, auth, from, []string{to}, body)
-	return err
+// NoticeEmail is an email telling the user something happened to their
+// account, without code
+func NoticeEmail(title string, heading string, text string, reason string) string {
+	return fmt.Sprintf(`<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="UTF-8">
+  <title>%s</title>
+</head>
+<body style="font-family: Arial, sans-serif; background-color: #f9fafb; margin: 0; padding: 0;">
+  <div style="background-color: #ffffff; max-width: 480px; margin: 40px auto; padding: 32px; border-radius: 8px; box-shadow: 0 2px 8px rgba(0,0,0,0.05);">
+    <div style="font-size: 20px; font-weight: 600; color: #111827; margin-bottom: 24px;">
+      %s
+    </div>
+    <div style="font-size: 14px; color: #4b5563;">
+      %s
+    </div>
+    <div style="font-size: 12px; color: #9ca3af; text-align: center; margin-top: 32px;">
+      Pingless · A self-hosted async status board<br>
+      %s
+    </div>
+  </div>
+</body>
+</html>
+`, title, heading, text, reason)
 }
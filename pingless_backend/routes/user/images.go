@@ -2,6 +2,7 @@ package user
 
 import (
 	"encoding/json"
+	"log"
 	"net/http"
 	"strconv"
 
@@ -25,6 +26,17 @@ func GetUserImages(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
 		return
 	}
 
+	blocked, err := blockedViewer(r, db, username)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if blocked {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
 	var images []struct {
 		ID        int    `db:"id"`
 		ImageType string `db:"image_type"`
@@ -42,7 +54,7 @@ func GetUserImages(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
 		ORDER BY i.image_type
 	`
 
-	err := db.Select(&images, query, username)
+	err = db.Select(&images, query, username)
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
@@ -86,13 +98,28 @@ func GetImageInfo(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
 		FileSize  int64  `db:"file_size"`
 		MimeType  string `db:"mime_type"`
 		UpdatedAt string `db:"updated_at"`
+		Owner     string `db:"username"`
 	}
 
-	err = db.Get(&image, "SELECT id, image_type, file_name, file_size, mime_type, updated_at FROM images WHERE id = ?", id)
+	err = db.Get(&image, `
+		SELECT i.id, i.image_type, i.file_name, i.file_size, i.mime_type, i.updated_at, u.username
+		FROM images i
+		JOIN users u ON i.user_id = u.id
+		WHERE i.id = ?`, id)
 	if err != nil {
 		http.Error(w, "Image not found", http.StatusNotFound)
 		return
 	}
+	blocked, err := blockedViewer(r, db, image.Owner)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if blocked {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
 
 	response := ImageResponse{
 		ID:        image.ID,
@@ -122,6 +149,17 @@ func GetUserImageByType(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
 		return
 	}
 
+	blocked, err := blockedViewer(r, db, username)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if blocked {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+
 	var image struct {
 		ID        int    `db:"id"`
 		ImageType string `db:"image_type"`
@@ -138,7 +176,7 @@ func GetUserImageByType(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
 		WHERE u.username = ? AND i.image_type = ?
 	`
 
-	err := db.Get(&image, query, username, imageType)
+	err = db.Get(&image, query, username, imageType)
 	if err != nil {
 		http.Error(w, "Image not found", http.StatusNotFound)
 		return
@@ -0,0 +1,224 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"pingless/internal/events"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+NOTE : This file deal with verifying profile links
+
+A link is verified when the page it points to links back to the profile of
+the user with rel="me", the way Mastodon does it. The profile url is
+PUBLIC_URL/users/<username>, without PUBLIC_URL nothing can be verified.
+
+The pages are fetched by the server, so only public addresses are dialed,
+an url pointing into the local network is never verified. Changing the
+links keeps the verification of the urls that stay.
+*/
+
+const (
+	LINK_FETCH_TIMEOUT   = 5 * time.Second
+	MAX_LINK_PAGE_SIZE   = 1 << 20 // 1MB
+	MAX_LINK_REDIRECTS   = 3
+	PROFILE_URL_TEMPLATE = "%s/users/%s"
+)
+
+var errPrivateAddress = errors.New("address is not public")
+
+var (
+	linkTag   = regexp.MustCompile(`(?is)<(?:a|link)\b[^>]*>`)
+	attribute = regexp.MustCompile(`(?is)\b(rel|href)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+)
+
+var linkClient = &http.Client{
+	Timeout: LINK_FETCH_TIMEOUT,
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: LINK_FETCH_TIMEOUT,
+			Control: publicOnly,
+		}).DialContext,
+		TLSHandshakeTimeout: LINK_FETCH_TIMEOUT,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= MAX_LINK_REDIRECTS {
+			return errors.New("too many redirects")
+		}
+		return nil
+	},
+}
+
+// publicOnly runs after the name is resolved, so a redirect or a DNS answer
+// cannot lead the fetch into the local network
+func publicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() ||
+		sharedAddressSpace.Contains(ip) {
+		return fmt.Errorf("%s: %w", host, errPrivateAddress)
+	}
+	return nil
+}
+
+// 100.64.0.0/10, carrier grade NAT
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// VerifyLinks checks every link of the caller again and answers with the
+// profile
+func VerifyLinks(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var publicURL string
+	err := db.Get(&publicURL, "SELECT value FROM settings WHERE key = 'publicURL'")
+	publicURL = strings.TrimRight(strings.TrimSpace(publicURL), "/")
+	if err != nil || publicURL == "" {
+		http.Error(w, "Link verification is not configured", http.StatusNotFound)
+		return
+	}
+
+	var encoded string
+	if err := db.Get(&encoded, "SELECT links FROM users WHERE username = ?", username); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	var links []string
+	if err := json.Unmarshal([]byte(encoded), &links); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	profileURL := fmt.Sprintf(PROFILE_URL_TEMPLATE, publicURL, username)
+	verified := verifiedLinks(r.Context(), links, profileURL)
+
+	// links is compared again so a concurrent update does not get a
+	// verification for urls it removed
+	verifiedEncoded, _ := json.Marshal(verified)
+	_, err = db.Exec(`
+		UPDATE users SET verified_links = ?
+		WHERE username = ? AND links = ?`, string(verifiedEncoded), username, encoded)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	profile, err := loadProfile(db, username, username)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	events.PublishUserUpdate(db, events.UserUpdate{
+		Username:      username,
+		VerifiedLinks: &profile.VerifiedLinks,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profile)
+}
+
+// verifiedLinks fetches the links at the same time and keeps, in order, the
+// ones whose page has a rel="me" link to profileURL
+func verifiedLinks(ctx context.Context, links []string, profileURL string) []string {
+	ok := make([]bool, len(links))
+	var wg sync.WaitGroup
+	for i, link := range links {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			found, err := linksBack(ctx, link, profileURL)
+			if err != nil {
+				log.Printf("verify link %s: %v", link, err)
+			}
+			ok[i] = found
+		}()
+	}
+	wg.Wait()
+
+	verified := []string{}
+	for i, link := range links {
+		if ok[i] && !slices.Contains(verified, link) {
+			verified = append(verified, link)
+		}
+	}
+	return verified
+}
+
+func linksBack(ctx context.Context, link string, profileURL string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "text/html")
+	res, err := linkClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("status %d", res.StatusCode)
+	}
+	page, err := io.ReadAll(io.LimitReader(res.Body, MAX_LINK_PAGE_SIZE))
+	if err != nil {
+		return false, err
+	}
+	return hasRelMe(string(page), profileURL), nil
+}
+
+// hasRelMe looks for <a> or <link> tags with rel="me" and an href to target
+func hasRelMe(page string, target string) bool {
+	target = strings.TrimRight(target, "/")
+	for _, tag := range linkTag.FindAllString(page, -1) {
+		var rel, href string
+		for _, attr := range attribute.FindAllStringSubmatch(tag, -1) {
+			value := html.UnescapeString(attr[2] + attr[3] + attr[4])
+			if strings.EqualFold(attr[1], "rel") {
+				rel = value
+			} else {
+				href = value
+			}
+		}
+		isMe := slices.ContainsFunc(strings.Fields(rel), func(token string) bool {
+			return strings.EqualFold(token, "me")
+		})
+		if isMe && strings.TrimRight(strings.TrimSpace(href), "/") == target {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,151 @@
+package user
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"pingless/internal/permissions"
+	"pingless/routes/role"
+	"strconv"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+NOTE : This file deal with the member directory
+
+GET /api/members takes
+	query    username prefix
+	role_id  only members of this role
+	sort     joined_asc (default) or joined_desc
+	limit    1 to 100
+	after    id of the last member of the previous page
+
+Members are ordered by join date then id, so after stays valid while people
+join.
+*/
+
+const (
+	DEFAULT_MEMBERS_LIMIT = 50
+	MAX_MEMBERS_LIMIT     = 100
+)
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func ListMembers(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	limit := DEFAULT_MEMBERS_LIMIT
+	if raw := query.Get("limit"); raw != "" {
+		var err error
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > MAX_MEMBERS_LIMIT {
+			http.Error(w, "Allowed limit 1 ≤ limit ≤ 100", http.StatusBadRequest)
+			return
+		}
+	}
+
+	where := []string{"1 = 1"}
+	args := []any{}
+	if prefix := strings.TrimSpace(query.Get("query")); prefix != "" {
+		where = append(where, `u.username LIKE ? ESCAPE '\'`)
+		args = append(args, likeEscaper.Replace(prefix)+"%")
+	}
+	if raw := query.Get("role_id"); raw != "" {
+		roleID, err := strconv.Atoi(raw)
+		if err != nil {
+			http.Error(w, "Invalid role_id", http.StatusBadRequest)
+			return
+		}
+		where = append(where, "EXISTS(SELECT 1 FROM user_roles ur WHERE ur.user_id = u.id AND ur.role_id = ?)")
+		args = append(args, roleID)
+	}
+
+	order, cmp := "ASC", ">"
+	switch query.Get("sort") {
+	case "", "joined_asc":
+	case "joined_desc":
+		order, cmp = "DESC", "<"
+	default:
+		http.Error(w, "sort must be joined_asc or joined_desc", http.StatusBadRequest)
+		return
+	}
+	if raw := query.Get("after"); raw != "" {
+		after, err := strconv.Atoi(raw)
+		if err != nil {
+			http.Error(w, "Invalid after", http.StatusBadRequest)
+			return
+		}
+		where = append(where, "(u.created_at, u.id) "+cmp+" (SELECT created_at, id FROM users WHERE id = ?)")
+		args = append(args, after)
+	}
+
+	showEmail, err := canSeeEmails(db, r, claims, username)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	members := []MemberResponse{}
+	err = db.Select(&members, `
+		SELECT u.id, u.username, u.email, u.created_at
+		FROM users u
+		WHERE `+strings.Join(where, " AND ")+`
+		ORDER BY u.created_at `+order+`, u.id `+order+`
+		LIMIT ?`, append(args, limit)...)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	ids := make([]int, len(members))
+	for i, member := range members {
+		ids[i] = member.ID
+	}
+	roles, err := role.UserRoles(db, ids...)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	for i := range members {
+		member := roles[members[i].ID]
+		members[i].RoleID, members[i].Role, members[i].Roles, members[i].Color = member.TopID, member.Top, member.IDs, member.Color
+		if !showEmail {
+			members[i].Email = ""
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(members)
+}
+
+// canSeeEmails is the server settings permission, a personal access token
+// needs its scope too and the session its second factor when admins must
+// use 2FA
+func canSeeEmails(db *sqlx.DB, r *http.Request, claims jwt.MapClaims, username string) (bool, error) {
+	if pat, _ := claims["pat"].(bool); pat && !hasScope(claims, SCOPE_SERVER_SETTINGS) {
+		return false, nil
+	}
+	perms, err := RequestPermissions(db, r, username)
+	if err != nil || !permissions.Has(perms, permissions.SERVER_SETTINGS) {
+		return false, err
+	}
+	missing, err := adminMfaMissing(db, claims, perms)
+	return !missing, err
+}
@@ -0,0 +1,518 @@
+package user
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"pingless/internal/auditlog"
+	"pingless/internal/totp"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*
+NOTE : This file deal with TOTP two factor authentication
+
+Flow:
+ 1. enroll  -> a new secret is stored (disabled) and returned with its otpauth uri
+ 2. confirm -> the first valid code enables 2FA and returns the recovery codes
+ 3. login   -> verify_user answers with an mfa_challenge instead of tokens,
+               verify_mfa exchanges challenge + code (or recovery code) for tokens
+*/
+
+const (
+	MFA_CHALLENGE_TTL          = 5 * time.Minute
+	MFA_CHALLENGE_MAX_ATTEMPTS = 5
+	RECOVERY_CODE_COUNT        = 10
+)
+
+func isMfaEnabled(db *sqlx.DB, userID int) (bool, error) {
+	var enabled bool
+	err := db.Get(&enabled, "SELECT enabled FROM user_mfa WHERE user_id = ?", userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return enabled, err
+}
+
+func createMfaChallenge(db *sqlx.DB, userID int) (string, error) {
+	challenge, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	_, err = db.Exec(`
+		INSERT INTO mfa_challenges (token_hash, user_id, expires_at)
+		VALUES (?, ?, ?)`,
+		hashToken(challenge), userID, time.Now().Add(MFA_CHALLENGE_TTL),
+	)
+	return challenge, err
+}
+
+func VerifyMfa(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	var verify VerifyMfaModel
+	if err := json.NewDecoder(r.Body).Decode(&verify); err != nil {
+		log.Println(err)
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	var challenge struct {
+		UserID    int       `db:"user_id"`
+		Username  string    `db:"username"`
+		Attempts  int       `db:"attempts"`
+		Consumed  bool      `db:"consumed"`
+		ExpiresAt time.Time `db:"expires_at"`
+	}
+	challengeHash := hashToken(verify.Challenge)
+	err := db.Get(&challenge, `
+		SELECT c.user_id, u.username, c.attempts, c.consumed, c.expires_at
+		FROM mfa_challenges c
+		JOIN users u ON c.user_id = u.id
+		WHERE c.token_hash = ?`, challengeHash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Invalid or expired challenge", http.StatusUnauthorized)
+			return
+		}
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if challenge.Consumed || challenge.Attempts >= MFA_CHALLENGE_MAX_ATTEMPTS || time.Now().After(challenge.ExpiresAt) {
+		http.Error(w, "Invalid or expired challenge", http.StatusUnauthorized)
+		return
+	}
+
+	// Throttled per account too, otherwise new challenges would give
+	// unlimited guesses to whoever knows the password
+	mfaKey := throttleKey("mfa", challenge.Username)
+	if rejectIfLocked(w, db, mfaKey, throttleKey("ip", clientIP(r))) {
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	valid, err := checkSecondFactor(tx, challenge.UserID, verify.Code, verify.RecoveryCode)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		if _, err := tx.Exec("UPDATE mfa_challenges SET attempts = attempts + 1 WHERE token_hash = ?", challengeHash); err != nil {
+			log.Println(err)
+		}
+		// The attempt counter has to be saved even though the login failed
+		if err := tx.Commit(); err != nil {
+			log.Println(err)
+		}
+		recordFailures(db, r, mfaKey, challenge.Username)
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	res, err := tx.Exec("UPDATE mfa_challenges SET consumed = TRUE WHERE token_hash = ? AND consumed = FALSE", challengeHash)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Invalid or expired challenge", http.StatusUnauthorized)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	clearFailures(db, mfaKey)
+	issueLogin(w, r, db, challenge.UserID, challenge.Username, true)
+}
+
+func EnrollMfa(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var userID int
+	if err := db.Get(&userID, "SELECT id FROM users WHERE username = ?", username); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	enabled, err := isMfaEnabled(db, userID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusBadRequest)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Secret Error", http.StatusInternalServerError)
+		return
+	}
+	// Enrolling again before confirming simply replaces the pending secret
+	_, err = db.Exec(`
+		INSERT INTO user_mfa (user_id, secret, enabled, last_used_step)
+		VALUES (?, ?, FALSE, 0)
+		ON CONFLICT(user_id) DO UPDATE SET
+			secret = excluded.secret,
+			enabled = FALSE,
+			last_used_step = 0
+	`, userID, secret)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	issuer := "Pingless"
+	var serverName string
+	if err := db.Get(&serverName, "SELECT name FROM server_settings WHERE id = 1"); err == nil && serverName != "" {
+		issuer = serverName
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":      secret,
+		"otpauth_uri": totp.URI(issuer, username, secret),
+	})
+}
+
+func ConfirmMfa(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var confirm MfaCodeModel
+	if err := json.NewDecoder(r.Body).Decode(&confirm); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	var mfa struct {
+		UserID  int    `db:"user_id"`
+		Secret  string `db:"secret"`
+		Enabled bool   `db:"enabled"`
+	}
+	err := db.Get(&mfa, `
+		SELECT m.user_id, m.secret, m.enabled
+		FROM user_mfa m
+		JOIN users u ON m.user_id = u.id
+		WHERE u.username = ?`, username)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Start enrollment first", http.StatusBadRequest)
+			return
+		}
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if mfa.Enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusBadRequest)
+		return
+	}
+
+	step, valid := totp.Validate(mfa.Secret, confirm.Code, time.Now())
+	if !valid {
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE user_mfa SET enabled = TRUE, last_used_step = ? WHERE user_id = ?", step, mfa.UserID); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	codes, err := replaceRecoveryCodes(tx, mfa.UserID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	auditlog.Record(db, auditlog.AuditLog{
+		UserName: username,
+		Action:   "enable_2fa",
+		Target:   "2fa",
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string][]string{
+		"recovery_codes": codes,
+	})
+}
+
+func DisableMfa(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var disable DisableMfaModel
+	if err := json.NewDecoder(r.Body).Decode(&disable); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	var userID int
+	var storedHash string
+	if err := db.QueryRow("SELECT id, password_hash FROM users WHERE username = ?", username).Scan(&userID, &storedHash); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(disable.Password)); err != nil {
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	valid, err := checkSecondFactor(tx, userID, disable.Code, disable.RecoveryCode)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	if _, err := tx.Exec("DELETE FROM user_mfa WHERE user_id = ?", userID); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM mfa_recovery_codes WHERE user_id = ?", userID); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	auditlog.Record(db, auditlog.AuditLog{
+		UserName: username,
+		Action:   "disable_2fa",
+		Target:   "2fa",
+	})
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("Two-factor authentication disabled\n"))
+}
+
+func RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var regenerate MfaCodeModel
+	if err := json.NewDecoder(r.Body).Decode(&regenerate); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	var userID int
+	if err := db.Get(&userID, "SELECT id FROM users WHERE username = ?", username); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Only a TOTP code is accepted here, a leaked recovery code must not be
+	// enough to mint a fresh set
+	valid, err := checkSecondFactor(tx, userID, regenerate.Code, "")
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string][]string{
+		"recovery_codes": codes,
+	})
+}
+
+// checkSecondFactor accepts either a TOTP code or an unused recovery code.
+// A TOTP code can only be used once, a recovery code is burned on use.
+func checkSecondFactor(tx *sqlx.Tx, userID int, code string, recoveryCode string) (bool, error) {
+	var mfa struct {
+		Secret       string `db:"secret"`
+		Enabled      bool   `db:"enabled"`
+		LastUsedStep int64  `db:"last_used_step"`
+	}
+	err := tx.Get(&mfa, "SELECT secret, enabled, last_used_step FROM user_mfa WHERE user_id = ?", userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	if !mfa.Enabled {
+		return false, nil
+	}
+
+	if code != "" {
+		step, valid := totp.Validate(mfa.Secret, code, time.Now())
+		if !valid || step <= mfa.LastUsedStep {
+			return false, nil
+		}
+		res, err := tx.Exec("UPDATE user_mfa SET last_used_step = ? WHERE user_id = ? AND last_used_step < ?", step, userID, step)
+		if err != nil {
+			return false, err
+		}
+		n, _ := res.RowsAffected()
+		return n == 1, nil
+	}
+
+	if recoveryCode != "" {
+		res, err := tx.Exec(`
+			UPDATE mfa_recovery_codes SET used = TRUE
+			WHERE user_id = ? AND code_hash = ? AND used = FALSE`,
+			userID, hashToken(normalizeRecoveryCode(recoveryCode)))
+		if err != nil {
+			return false, err
+		}
+		n, _ := res.RowsAffected()
+		return n == 1, nil
+	}
+	return false, nil
+}
+
+// replaceRecoveryCodes drops the old codes and returns a new plaintext set,
+// which is the only time the user gets to see them
+func replaceRecoveryCodes(tx *sqlx.Tx, userID int) ([]string, error) {
+	if _, err := tx.Exec("DELETE FROM mfa_recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	codes := make([]string, 0, RECOVERY_CODE_COUNT)
+	for range RECOVERY_CODE_COUNT {
+		buf := make([]byte, 5)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		raw := strings.ToLower(encoding.EncodeToString(buf))
+		code := raw[:4] + "-" + raw[4:]
+		if _, err := tx.Exec("INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, hashToken(normalizeRecoveryCode(code))); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.ReplaceAll(code, "-", "")
+}
@@ -2,81 +2,248 @@ package user
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
 	"errors"
 	"log"
 	"net/http"
-	"os"
+	"pingless/internal/permissions"
+	"pingless/internal/signing"
 	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/jmoiron/sqlx"
 )
 
-func VerifiyAccessToken(next http.Handler) http.Handler {
-	secretKey := os.Getenv("SECRETKEY")
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authHeader := strings.Split(r.Header.Get("Authorization"), "Bearer ")
-		if len(authHeader) != 2 {
-			log.Println("Malformed token")
-			http.Error(w, "Malformed Token", http.StatusUnauthorized)
-			return
-		}
+// AuthError is an authentication failure, Status is what the client is
+// answered with
+type AuthError struct {
+	Status  int
+	Message string
+}
+
+func (e *AuthError) Error() string {
+	return e.Message
+}
+
+var errUnauthorized = &AuthError{Status: http.StatusUnauthorized, Message: "Unauthorized"}
 
-		jwtToken := authHeader[1]
-		token, err := jwt.Parse(jwtToken, func(token *jwt.Token) (any, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, errors.New("Unexpected signing method")
+// VerifiyAccessToken accepts the access token of a session. Personal access
+// tokens are accepted only when scopes are given and the token has all of them.
+func VerifiyAccessToken(db *sqlx.DB, scopes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authHeader := strings.Split(r.Header.Get("Authorization"), "Bearer ")
+			if len(authHeader) != 2 {
+				log.Println("Malformed token")
+				http.Error(w, "Malformed Token", http.StatusUnauthorized)
+				return
 			}
-			return []byte(secretKey), nil
+
+			claims, err := Authenticate(db, r, authHeader[1], scopes...)
+			if err != nil {
+				var authErr *AuthError
+				if errors.As(err, &authErr) {
+					http.Error(w, authErr.Message, authErr.Status)
+					return
+				}
+				log.Println(err)
+				http.Error(w, "DB ERROR", http.StatusInternalServerError)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), "props", claims)
+			next.ServeHTTP(w, r.WithContext(ctx))
 		})
+	}
+}
 
+// Authenticate checks token like VerifiyAccessToken does and returns its
+// claims. A rejected token gives an *AuthError, any other error is a DB error.
+func Authenticate(db *sqlx.DB, r *http.Request, token string, scopes ...string) (jwt.MapClaims, error) {
+	if isPersonalAccessToken(token) {
+		if len(scopes) == 0 {
+			return nil, &AuthError{Status: http.StatusForbidden, Message: "Personal access tokens are not accepted here"}
+		}
+		claims, err := checkPersonalAccessToken(db, token)
 		if err != nil {
-			log.Println("JWT parse error:", err)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
+			if errors.Is(err, errPatInvalid) {
+				return nil, errUnauthorized
+			}
+			return nil, err
 		}
+		for _, scope := range scopes {
+			if !hasScope(claims, scope) {
+				return nil, &AuthError{Status: http.StatusForbidden, Message: "Token is missing the " + scope + " scope"}
+			}
+		}
+		return claims, nil
+	}
+
+	parsed, err := signing.Parse(db, token)
+	if err != nil {
+		log.Println("JWT parse error:", err)
+		return nil, errUnauthorized
+	}
+	claims, ok := parsed.Claims.(jwt.MapClaims)
+	if !ok || !parsed.Valid {
+		log.Println("Invalid token or claims")
+		return nil, errUnauthorized
+	}
+	// Access tokens have neither, registration tickets are signed with the
+	// same key and have both
+	if _, typed := claims["typ"]; typed {
+		return nil, errUnauthorized
+	}
+	if _, audience := claims["aud"]; audience {
+		return nil, errUnauthorized
+	}
 
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok || !token.Valid {
-			log.Println("Invalid token or claims")
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
+	// Tokens are only valid as long as their session is
+	valid, err := StillAuthenticated(db, r, claims)
+	if err != nil {
+		return nil, err
+	}
+	if !valid {
+		return nil, &AuthError{Status: http.StatusUnauthorized, Message: "Session revoked"}
+	}
+	return claims, nil
+}
+
+// StillAuthenticated reports whether the session or personal access token
+// claims were made from is still alive, without looking at the expiry of the
+// access token. Long lived connections use it to notice a logout.
+func StillAuthenticated(db *sqlx.DB, r *http.Request, claims jwt.MapClaims) (bool, error) {
+	if pat, _ := claims["pat"].(bool); pat {
+		var pat struct {
+			Revoked   bool         `db:"revoked"`
+			ExpiresAt sql.NullTime `db:"expires_at"`
 		}
+		err := db.Get(&pat, "SELECT revoked, expires_at FROM personal_access_tokens WHERE id = ?", claims["pat_id"])
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return false, nil
+			}
+			return false, err
+		}
+		return !pat.Revoked && !(pat.ExpiresAt.Valid && time.Now().After(pat.ExpiresAt.Time)), nil
+	}
 
-		ctx := context.WithValue(r.Context(), "props", claims)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+	username, _ := claims["username"].(string)
+	sessionID, _ := claims["sid"].(string)
+	issuedAt, err := claims.GetIssuedAt()
+	if sessionID == "" || err != nil || issuedAt == nil {
+		log.Println("Token without session")
+		return false, nil
+	}
+	valid, err := checkSession(db, r, sessionID, username, issuedAt.Time)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+	return valid, nil
 }
 
-func IsGifAllowed(db *sqlx.DB) func(http.Handler) http.Handler {
+// RequirePermission lets the request through when the caller has every bit
+// of perms server wide. The permissions are resolved once per request and
+// kept in the context for the next middlewares and the handler.
+//
+// The server may require those who can change its settings to use 2FA,
+// their session must then have been opened with a second factor whatever
+// the route asks for.
+func RequirePermission(db *sqlx.DB, perms ...int64) func(http.Handler) http.Handler {
+	var want int64
+	for _, perm := range perms {
+		want |= perm
+	}
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			var gifAllowed string
-			err := db.QueryRow("SELECT value FROM settings WHERE key = 'GifAllowed'").Scan(&gifAllowed)
+			claims, ok := r.Context().Value("props").(jwt.MapClaims)
+			if !ok {
+				log.Println("Invalid token claims context")
+				http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+				return
+			}
+			have, cached := permissions.FromContext(r.Context())
+			if !cached {
+				username, _ := claims["username"].(string)
+				var err error
+				have, err = permissions.Resolve(db, username, 0)
+				if err != nil {
+					log.Println(err)
+					http.Error(w, "DB ERROR", http.StatusInternalServerError)
+					return
+				}
+				r = r.WithContext(permissions.WithPermissions(r.Context(), have))
+			}
+			if !permissions.Has(have, want) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(PermissionError{
+					Error:   "Missing permission",
+					Missing: strings.Split(permissions.Names(want&^have), ","),
+				})
+				return
+			}
+			missing, err := adminMfaMissing(db, claims, have)
 			if err != nil {
-				http.Error(w, "DB ERROR", http.StatusUnauthorized)
+				log.Println(err)
+				http.Error(w, "DB ERROR", http.StatusInternalServerError)
 				return
 			}
-			log.Println(gifAllowed)
-			if gifAllowed != "true" {
-				http.Error(w, "Server Dont allow GIF pfp/header", http.StatusUnauthorized)
+			if missing {
+				http.Error(w, "Two-factor authentication required", http.StatusForbidden)
 				return
 			}
 			next.ServeHTTP(w, r)
 		})
 	}
 }
-func IsInviteOnly(db *sqlx.DB) func(http.Handler) http.Handler {
+
+// AdminMfaRequired reports whether the server requires 2FA from those who
+// can change its settings
+func AdminMfaRequired(db *sqlx.DB) (bool, error) {
+	var required string
+	err := db.Get(&required, "SELECT value FROM settings WHERE key = 'requireMfaForAdmins'")
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return required == "true", err
+}
+
+// adminMfaMissing is true when perms make the caller an admin, the server
+// requires 2FA from admins and the session was opened without it
+func adminMfaMissing(db *sqlx.DB, claims jwt.MapClaims, perms int64) (bool, error) {
+	if !permissions.Has(perms, permissions.SERVER_SETTINGS) {
+		return false, nil
+	}
+	if mfa, _ := claims["mfa"].(bool); mfa {
+		return false, nil
+	}
+	return AdminMfaRequired(db)
+}
+
+// RequestPermissions returns the server wide permissions of username, the
+// ones RequirePermission cached when there are
+func RequestPermissions(db *sqlx.DB, r *http.Request, username string) (int64, error) {
+	if perms, ok := permissions.FromContext(r.Context()); ok {
+		return perms, nil
+	}
+	return permissions.Resolve(db, username, 0)
+}
+
+func IsGifAllowed(db *sqlx.DB) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			var inviteOnly string
-			err := db.QueryRow("SELECT value FROM settings WHERE key = 'inviteOnly'").Scan(&inviteOnly)
+			var gifAllowed string
+			err := db.QueryRow("SELECT value FROM settings WHERE key = 'GifAllowed'").Scan(&gifAllowed)
 			if err != nil {
 				http.Error(w, "DB ERROR", http.StatusUnauthorized)
 				return
 			}
-			if inviteOnly == "true" {
-				http.Error(w, "Server is invite only", http.StatusUnauthorized)
+			log.Println(gifAllowed)
+			if gifAllowed != "true" {
+				http.Error(w, "Server Dont allow GIF pfp/header", http.StatusUnauthorized)
 				return
 			}
 			next.ServeHTTP(w, r)
@@ -19,9 +19,11 @@ type OtpVerifyModel struct {
 }
 
 type CreateUserModel struct {
-	Email    string `json:"email" db:"email"`
-	Password string `json:"password" db:"password"`
-	Username string `json:"username" db:"username"`
+	Email      string `json:"email" db:"email"`
+	Password   string `json:"password" db:"password"`
+	Username   string `json:"username" db:"username"`
+	InviteCode string `json:"invite_code" db:"-"`
+	Ticket     string `json:"registration_ticket" db:"-"`
 }
 
 type VerifyUserModel struct {
@@ -33,7 +35,169 @@ type UpdateBioModel struct {
 	Bio string `json:"bio" db:"bio"`
 }
 
+// Fields left out are not changed, "" (or [] for links) clears one
+type UpdateProfileModel struct {
+	Bio         *string   `json:"bio"`
+	DisplayName *string   `json:"display_name"`
+	Pronouns    *string   `json:"pronouns"`
+	AccentColor *string   `json:"accent_color"` // #RRGGBB
+	Timezone    *string   `json:"timezone"`     // IANA name, Europe/Paris
+	Links       *[]string `json:"links"`
+}
+
 type changePasswordModel struct {
 	Password    string `json:"password" db:"password"`
-	NewPassword string `json : "new_password"`
+	NewPassword string `json:"new_password"`
+}
+
+type refreshTokenRow struct {
+	ID        int       `db:"id"`
+	UserID    int       `db:"user_id"`
+	FamilyID  string    `db:"family_id"`
+	Rotated   bool      `db:"rotated"`
+	Revoked   bool      `db:"revoked"`
+	ExpiresAt time.Time `db:"expires_at"`
+
+	SessionRevoked bool `db:"session_revoked"`
+	SessionMfa     bool `db:"session_mfa"`
+}
+
+type SessionResponse struct {
+	ID         string    `json:"id" db:"id"`
+	UserAgent  string    `json:"user_agent" db:"user_agent"`
+	IP         string    `json:"ip" db:"ip"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at" db:"last_seen_at"`
+	Current    bool      `json:"current" db:"-"`
+}
+
+type RevokeSessionModel struct {
+	SessionID string `json:"session_id"`
+}
+
+type ResetPasswordModel struct {
+	Email       string `json:"email"`
+	Otp         string `json:"otp"`
+	NewPassword string `json:"new_password"`
+}
+
+type MfaCodeModel struct {
+	Code string `json:"code"`
+}
+
+type VerifyMfaModel struct {
+	Challenge    string `json:"mfa_challenge"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type DisableMfaModel struct {
+	Password     string `json:"password"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type CreatePersonalAccessTokenModel struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn int      `json:"expires_in"` // seconds, 0 = never
+}
+
+type RevokePersonalAccessTokenModel struct {
+	ID int `json:"id"`
+}
+
+type PersonalAccessTokenResponse struct {
+	ID         int        `json:"id" db:"id"`
+	Name       string     `json:"name" db:"name"`
+	Prefix     string     `json:"prefix" db:"token_prefix"`
+	ScopeList  string     `json:"-" db:"scopes"`
+	Scopes     []string   `json:"scopes" db:"-"`
+	ExpiresAt  *time.Time `json:"expires_at" db:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at" db:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	Expired    bool       `json:"expired" db:"-"`
+}
+
+type PresenceHeartbeatModel struct {
+	Status string `json:"status"` // empty keeps the current one
+}
+
+type CustomStatusModel struct {
+	Text      string `json:"text"`       // empty clears the status
+	ExpiresIn int    `json:"expires_in"` // seconds, 0 = never
+}
+
+type CustomStatusResponse struct {
+	Text      string     `json:"text"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type PresenceResponse struct {
+	Username     string                `json:"username"`
+	Presence     string                `json:"presence"`
+	CustomStatus *CustomStatusResponse `json:"custom_status"`
+}
+
+type RelationshipModel struct {
+	Username string `json:"username"`
+}
+
+type RelationshipResponse struct {
+	Username string `json:"username"`
+	Status   string `json:"status"`
+}
+
+type RelationshipListResponse struct {
+	Username string    `json:"username" db:"username"`
+	Since    time.Time `json:"since" db:"created_at"`
+}
+
+// Image urls are null when the user has not uploaded one
+type ProfileResponse struct {
+	Username      string                `json:"username" db:"username"`
+	DisplayName   string                `json:"display_name" db:"display_name"`
+	Bio           string                `json:"bio" db:"bio"`
+	Pronouns      string                `json:"pronouns" db:"pronouns"`
+	AccentColor   string                `json:"accent_color" db:"accent_color"`
+	Timezone      string                `json:"timezone" db:"timezone"`
+	Links         []string              `json:"links" db:"-"`
+	VerifiedLinks []string              `json:"verified_links" db:"-"` // links whose page links back
+	Role          string                `json:"role" db:"-"`           // highest role
+	Roles         []int                 `json:"roles" db:"-"`          // role ids, highest first
+	Color         string                `json:"color" db:"-"`          // of the highest role with one
+	JoinedAt      time.Time             `json:"joined_at" db:"created_at"`
+	Pfp           *string               `json:"pfp" db:"-"`
+	Banner        *string               `json:"banner" db:"-"`
+	Presence      string                `json:"presence" db:"-"`
+	CustomStatus  *CustomStatusResponse `json:"custom_status" db:"-"`
+}
+
+type MeResponse struct {
+	ProfileResponse
+	Email    string          `json:"email"`
+	Settings AccountSettings `json:"settings"`
+}
+
+type AccountSettings struct {
+	TwoFactorEnabled bool     `json:"two_factor_enabled"`
+	LinkedProviders  []string `json:"linked_providers"` // OIDC issuers
+}
+
+// Email is only sent to members who can change server settings
+type MemberResponse struct {
+	ID       int       `json:"id" db:"id"`
+	Username string    `json:"username" db:"username"`
+	Email    string    `json:"email,omitempty" db:"email"`
+	RoleID   int       `json:"role_id" db:"-"` // highest role
+	Role     string    `json:"role" db:"-"`
+	Roles    []int     `json:"roles" db:"-"`
+	Color    string    `json:"color" db:"-"`
+	JoinedAt time.Time `json:"joined_at" db:"created_at"`
+}
+
+// Answer of RequirePermission, missing lists the permission names
+type PermissionError struct {
+	Error   string   `json:"error"`
+	Missing []string `json:"missing"`
 }
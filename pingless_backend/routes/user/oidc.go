@@ -0,0 +1,526 @@
+package user
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"pingless/internal/auditlog"
+	"pingless/internal/events"
+	"pingless/internal/oidc"
+	"pingless/internal/permissions"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*
+NOTE : This file deal with single sign-on through an OpenID Connect provider
+
+/api/user/oidc/login sends the browser to the IdP, the IdP sends it back to
+/api/user/oidc/callback with a code that is exchanged (with the PKCE
+verifier) for an ID token. The state is also kept in a cookie of the
+browser that started the login, a callback from any other browser is
+refused so nobody can be signed into someone else's account. The token's
+issuer + sub are linked to a user: an existing link wins, otherwise a new
+user is provisioned, unless the server is invite only. An account that
+already has the email is not linked on the IdP's word, its owner logs in and
+starts /api/user/oidc/link instead. The answer is the same as
+/api/user/verify_user.
+
+IdP groups decide roles when OIDC_ROLE_MAP is set. Roles named in the map
+are managed by the IdP: the user has each of them while in one of its
+groups and loses it otherwise, other roles are left alone. The Owner and
+Member roles are never given or taken away this way.
+*/
+
+const (
+	OIDC_LOGIN_TTL    = 10 * time.Minute
+	MAX_USERNAME_SIZE = 32
+	OIDC_STATE_COOKIE = "oidc_state"
+)
+
+var errOidcNoEmail = errors.New("identity provider did not return a verified email")
+var errOidcNoProvision = errors.New("no pingless account for this identity")
+var errOidcAccountExists = errors.New("an account with this email already exists, log in and link this identity from it")
+var errOidcLinkedElsewhere = errors.New("this identity is linked to another account")
+
+type oidcSettings struct {
+	Issuer        string
+	ClientID      string
+	ClientSecret  string
+	RedirectURL   string
+	GroupsClaim   string
+	RoleMap       string
+	AutoProvision bool
+}
+
+func loadOidcSettings(db *sqlx.DB) (oidcSettings, error) {
+	var rows []struct {
+		Key   string `db:"key"`
+		Value string `db:"value"`
+	}
+	if err := db.Select(&rows, "SELECT key, value FROM settings WHERE key LIKE 'oidc%'"); err != nil {
+		return oidcSettings{}, err
+	}
+	var s oidcSettings
+	for _, row := range rows {
+		switch row.Key {
+		case "oidcIssuer":
+			s.Issuer = row.Value
+		case "oidcClientID":
+			s.ClientID = row.Value
+		case "oidcClientSecret":
+			s.ClientSecret = row.Value
+		case "oidcRedirectURL":
+			s.RedirectURL = row.Value
+		case "oidcGroupsClaim":
+			s.GroupsClaim = row.Value
+		case "oidcRoleMap":
+			s.RoleMap = row.Value
+		case "oidcAutoProvision":
+			s.AutoProvision = row.Value == "true"
+		}
+	}
+	return s, nil
+}
+
+// oidcProvider returns the configured provider, nil when OIDC is disabled
+func oidcProvider(w http.ResponseWriter, db *sqlx.DB) (*oidc.Provider, oidcSettings, bool) {
+	settings, err := loadOidcSettings(db)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return nil, settings, false
+	}
+	if settings.Issuer == "" || settings.ClientID == "" || settings.RedirectURL == "" {
+		http.Error(w, "OIDC login is not configured", http.StatusNotFound)
+		return nil, settings, false
+	}
+	provider, err := oidc.Discover(settings.Issuer)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return nil, settings, false
+	}
+	return provider, settings, true
+}
+
+func OidcLogin(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	provider, settings, ok := oidcProvider(w, db)
+	if !ok {
+		return
+	}
+	authorizeURL, ok := startOidcLogin(w, db, provider, settings, nil)
+	if !ok {
+		return
+	}
+	http.Redirect(w, r, authorizeURL, http.StatusFound)
+}
+
+// OidcLink starts a login that links the IdP account to the caller. The
+// answer is the IdP URL to send the browser to, the callback then logs the
+// caller in like OidcLogin does.
+func OidcLink(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	provider, settings, ok := oidcProvider(w, db)
+	if !ok {
+		return
+	}
+	var userID int
+	if err := db.Get(&userID, "SELECT id FROM users WHERE username = ?", username); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	authorizeURL, ok := startOidcLogin(w, db, provider, settings, &userID)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"url": authorizeURL})
+}
+
+// startOidcLogin stores a pending login, linkUserID is set when it links an
+// account instead of logging in, and returns the IdP authorize URL
+func startOidcLogin(w http.ResponseWriter, db *sqlx.DB, provider *oidc.Provider, settings oidcSettings, linkUserID *int) (string, bool) {
+	state, errState := oidc.RandomString(24)
+	nonce, errNonce := oidc.RandomString(24)
+	verifier, challenge, errPkce := oidc.NewPKCE()
+	if err := errors.Join(errState, errNonce, errPkce); err != nil {
+		log.Println(err)
+		http.Error(w, "Token Error", http.StatusInternalServerError)
+		return "", false
+	}
+
+	now := time.Now()
+	if _, err := db.Exec("DELETE FROM oidc_logins WHERE expires_at < ?", now); err != nil {
+		log.Println(err)
+	}
+	_, err := db.Exec("INSERT INTO oidc_logins (state, nonce, code_verifier, link_user_id, expires_at) VALUES (?, ?, ?, ?, ?)",
+		state, nonce, verifier, linkUserID, now.Add(OIDC_LOGIN_TTL))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return "", false
+	}
+
+	setOidcStateCookie(w, state, int(OIDC_LOGIN_TTL.Seconds()))
+	scopes := []string{"openid", "email", "profile"}
+	return provider.AuthCodeURL(settings.ClientID, settings.RedirectURL, state, nonce, challenge, scopes), true
+}
+
+func OidcCallback(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	provider, settings, ok := oidcProvider(w, db)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	if idpErr := query.Get("error"); idpErr != "" {
+		http.Error(w, "Login refused by identity provider: "+idpErr, http.StatusUnauthorized)
+		return
+	}
+	state, code := query.Get("state"), query.Get("code")
+	if state == "" || code == "" {
+		http.Error(w, "Missing state or code", http.StatusBadRequest)
+		return
+	}
+
+	cookie, err := r.Cookie(OIDC_STATE_COOKIE)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		http.Error(w, "Invalid or expired login", http.StatusBadRequest)
+		return
+	}
+	setOidcStateCookie(w, "", -1)
+
+	// The state is single use, it is deleted whatever happens next
+	var login struct {
+		Nonce        string    `db:"nonce"`
+		CodeVerifier string    `db:"code_verifier"`
+		LinkUserID   *int      `db:"link_user_id"`
+		ExpiresAt    time.Time `db:"expires_at"`
+	}
+	err = db.Get(&login, "DELETE FROM oidc_logins WHERE state = ? RETURNING nonce, code_verifier, link_user_id, expires_at", state)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Invalid or expired login", http.StatusBadRequest)
+			return
+		}
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if time.Now().After(login.ExpiresAt) {
+		http.Error(w, "Invalid or expired login", http.StatusBadRequest)
+		return
+	}
+
+	rawIDToken, err := provider.Exchange(settings.ClientID, settings.ClientSecret, settings.RedirectURL, code, login.CodeVerifier)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Code exchange failed", http.StatusUnauthorized)
+		return
+	}
+	claims, err := provider.VerifyIDToken(rawIDToken, settings.ClientID, login.Nonce)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Invalid ID token", http.StatusUnauthorized)
+		return
+	}
+
+	userID, username, err := linkOidcIdentity(db, r, provider.Issuer, settings, claims, login.LinkUserID)
+	if err != nil {
+		if errors.Is(err, errOidcNoEmail) || errors.Is(err, errOidcNoProvision) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if errors.Is(err, errOidcAccountExists) || errors.Is(err, errOidcLinkedElsewhere) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	completeLogin(w, r, db, userID, username)
+}
+
+// setOidcStateCookie ties a login to the browser, a negative maxAge clears it
+func setOidcStateCookie(w http.ResponseWriter, state string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     OIDC_STATE_COOKIE,
+		Value:    state,
+		Path:     "/api/user/oidc",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   maxAge,
+	})
+}
+
+// linkOidcIdentity finds or creates the user behind the ID token and brings
+// its roles in line with the IdP groups. With linkUserID the identity is
+// linked to that user, who started the login while signed in.
+func linkOidcIdentity(db *sqlx.DB, r *http.Request, issuer string, settings oidcSettings, claims jwt.MapClaims, linkUserID *int) (int, string, error) {
+	subject, _ := claims["sub"].(string)
+	email, _ := claims["email"].(string)
+	emailVerified, _ := claims["email_verified"].(bool)
+	email = strings.ToLower(strings.TrimSpace(email))
+
+	inviteOnly, err := isInviteOnly(db)
+	if err != nil {
+		return 0, "", err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	action := ""
+	var user struct {
+		ID       int    `db:"id"`
+		Username string `db:"username"`
+	}
+	err = tx.Get(&user, `
+		SELECT u.id, u.username
+		FROM user_identities i
+		JOIN users u ON i.user_id = u.id
+		WHERE i.issuer = ? AND i.subject = ?`, issuer, subject)
+	switch {
+	case err == nil:
+		if linkUserID != nil && *linkUserID != user.ID {
+			return 0, "", errOidcLinkedElsewhere
+		}
+		if _, err := tx.Exec("UPDATE user_identities SET last_login_at = ? WHERE issuer = ? AND subject = ?", now, issuer, subject); err != nil {
+			return 0, "", err
+		}
+	case errors.Is(err, sql.ErrNoRows) && linkUserID != nil:
+		if err := tx.Get(&user, "SELECT id, username FROM users WHERE id = ?", *linkUserID); err != nil {
+			return 0, "", err
+		}
+		action = "oidc_link"
+	case errors.Is(err, sql.ErrNoRows):
+		if email == "" || !emailVerified {
+			return 0, "", errOidcNoEmail
+		}
+		// An existing account is never taken over on the IdP's word, its
+		// owner has to log in and link the identity
+		var exists bool
+		if err := tx.Get(&exists, "SELECT EXISTS(SELECT 1 FROM users WHERE lower(email) = ?)", email); err != nil {
+			return 0, "", err
+		}
+		if exists {
+			return 0, "", errOidcAccountExists
+		}
+		if !settings.AutoProvision || inviteOnly {
+			return 0, "", errOidcNoProvision
+		}
+		user.Username, err = freeUsername(tx, claims)
+		if err != nil {
+			return 0, "", err
+		}
+		// The account has no usable password until the user sets one
+		// with /api/user/forgot_password
+		password, err := randomToken(32)
+		if err != nil {
+			return 0, "", err
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return 0, "", err
+		}
+		newUser := CreateUserModel{Email: email, Username: user.Username, Password: string(hash)}
+		if err := insertUser(tx, &newUser, permissions.MEMBER_ROLE); err != nil {
+			return 0, "", err
+		}
+		if err := tx.Get(&user.ID, "SELECT id FROM users WHERE username = ?", user.Username); err != nil {
+			return 0, "", err
+		}
+		action = "oidc_provision"
+	default:
+		return 0, "", err
+	}
+	if action != "" {
+		_, err = tx.Exec(`
+			INSERT INTO user_identities (issuer, subject, user_id, created_at, last_login_at)
+			VALUES (?, ?, ?, ?, ?)`, issuer, subject, user.ID, now, now)
+		if err != nil {
+			return 0, "", err
+		}
+	}
+
+	added, removed, err := syncMappedRoles(tx, settings, claims, user.ID)
+	if err != nil {
+		return 0, "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, "", err
+	}
+
+	if action != "" {
+		auditlog.Record(db, auditlog.AuditLog{
+			UserName: user.Username,
+			Action:   action,
+			Target:   "user",
+			Metadata: map[string]string{
+				"issuer":  issuer,
+				"subject": subject,
+				"ip":      clientIP(r),
+			},
+		})
+	}
+	if action == "oidc_provision" {
+		events.Publish(db, events.USER_CREATE, events.UserCreate{Username: user.Username, CreatedAt: now})
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		auditlog.Record(db, auditlog.AuditLog{
+			UserName: user.Username,
+			Action:   "oidc_role_sync",
+			Target:   "user",
+			Metadata: map[string]string{
+				"added_role_ids":   joinInts(added),
+				"removed_role_ids": joinInts(removed),
+			},
+		})
+	}
+	return user.ID, user.Username, nil
+}
+
+// syncMappedRoles gives userID the mapped roles of their IdP groups and
+// takes the other mapped roles away
+func syncMappedRoles(tx *sqlx.Tx, settings oidcSettings, claims jwt.MapClaims, userID int) ([]int, []int, error) {
+	if settings.RoleMap == "" {
+		return nil, nil, nil
+	}
+
+	groups := map[string]bool{}
+	switch v := claims[settings.GroupsClaim].(type) {
+	case []any:
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				groups[s] = true
+			}
+		}
+	case string:
+		groups[v] = true
+	}
+
+	// managed is true for the roles the user should have
+	managed := map[int]bool{}
+	for _, entry := range strings.Split(settings.RoleMap, ",") {
+		group, roleName, found := strings.Cut(entry, ":")
+		if !found {
+			continue
+		}
+		var roleID int
+		err := tx.Get(&roleID, "SELECT id FROM roles WHERE name = ?", strings.TrimSpace(roleName))
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				log.Printf("OIDC_ROLE_MAP: unknown role %q", roleName)
+				continue
+			}
+			return nil, nil, err
+		}
+		if roleID == permissions.OWNER_ROLE || roleID == permissions.MEMBER_ROLE {
+			log.Println("OIDC_ROLE_MAP: the Owner and Member roles cannot be mapped")
+			continue
+		}
+		managed[roleID] = managed[roleID] || groups[strings.TrimSpace(group)]
+	}
+
+	var current []int
+	if err := tx.Select(&current, "SELECT role_id FROM user_roles WHERE user_id = ?", userID); err != nil {
+		return nil, nil, err
+	}
+	var added, removed []int
+	for roleID, wanted := range managed {
+		has := slices.Contains(current, roleID)
+		switch {
+		case wanted && !has:
+			if _, err := tx.Exec("INSERT INTO user_roles (user_id, role_id) VALUES (?, ?)", userID, roleID); err != nil {
+				return nil, nil, err
+			}
+			added = append(added, roleID)
+		case !wanted && has:
+			if _, err := tx.Exec("DELETE FROM user_roles WHERE user_id = ? AND role_id = ?", userID, roleID); err != nil {
+				return nil, nil, err
+			}
+			removed = append(removed, roleID)
+		}
+	}
+	slices.Sort(added)
+	slices.Sort(removed)
+	return added, removed, nil
+}
+
+func joinInts(ids []int) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.Itoa(id)
+	}
+	return strings.Join(parts, ",")
+}
+
+// freeUsername picks a username from the ID token claims, adding a number
+// when it is already taken
+func freeUsername(tx *sqlx.Tx, claims jwt.MapClaims) (string, error) {
+	base := ""
+	for _, claim := range []string{"preferred_username", "nickname", "email"} {
+		if v, _ := claims[claim].(string); v != "" {
+			base, _, _ = strings.Cut(v, "@")
+			break
+		}
+	}
+	base = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-', r == '.':
+			return r
+		}
+		return -1
+	}, base)
+	if base == "" {
+		base = "user"
+	}
+	if len(base) > MAX_USERNAME_SIZE-4 {
+		base = base[:MAX_USERNAME_SIZE-4]
+	}
+
+	username := base
+	for i := 2; i < 1000; i++ {
+		var taken bool
+		if err := tx.Get(&taken, "SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)", username); err != nil {
+			return "", err
+		}
+		if !taken {
+			return username, nil
+		}
+		username = fmt.Sprintf("%s%d", base, i)
+	}
+	return "", errors.New("no free username for " + base)
+}
@@ -0,0 +1,235 @@
+package user
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"pingless/internal/auditlog"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*
+NOTE : This file deal with the forgot password flow
+
+The reset code is a normal 6 digit otp but it is stored in one_time_codes
+with its own purpose, so it can never be used to verify an email and a
+signup otp can never be used to reset a password.
+*/
+
+const (
+	PURPOSE_PASSWORD_RESET = "password_reset"
+
+	RESET_CODE_TTL             = 15 * time.Minute
+	RESET_CODE_RESEND_AFTER    = time.Minute
+	ONE_TIME_CODE_MAX_ATTEMPTS = 5
+)
+
+var errCodeInvalid = errors.New("invalid or expired code")
+var errCodeAttempts = errors.New("too many attempts")
+
+func ForgotPassword(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	var forgot EmailSend
+	if err := json.NewDecoder(r.Body).Decode(&forgot); err != nil {
+		log.Println(err)
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	// The response is the same whether the account exists or not, and
+	// whether a code was sent or held back, so this endpoint cannot be used
+	// to find out which emails are registered.
+	if err := sendResetCode(db, forgot.Email); err != nil {
+		log.Println(err)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("Email Send\n"))
+}
+
+// sendResetCode mails a new reset code to email. Nothing is sent when no
+// account has the email or a code was sent less than a minute ago.
+func sendResetCode(db *sqlx.DB, email string) error {
+	var userID int
+	err := db.Get(&userID, "SELECT id FROM users WHERE email = ?", email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var lastSent time.Time
+	err = db.Get(&lastSent, "SELECT created_at FROM one_time_codes WHERE user_id = ? AND purpose = ?", userID, PURPOSE_PASSWORD_RESET)
+	if err == nil && time.Since(lastSent) < RESET_CODE_RESEND_AFTER {
+		return nil
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	otp := generateOtp()
+	if err := storeOneTimeCode(db, userID, PURPOSE_PASSWORD_RESET, otp, RESET_CODE_TTL); err != nil {
+		return err
+	}
+	return SendEmail(db, email, passwordResetSubject, passwordResetEmail(otp))
+}
+
+func ResetPassword(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	var reset ResetPasswordModel
+	if err := json.NewDecoder(r.Body).Decode(&reset); err != nil {
+		log.Println(err)
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if reset.NewPassword == "" {
+		http.Error(w, "New password required", http.StatusBadRequest)
+		return
+	}
+
+	resetKey := throttleKey("reset", reset.Email)
+	if rejectIfLocked(w, db, resetKey, throttleKey("ip", clientIP(r))) {
+		return
+	}
+
+	var account struct {
+		ID       int    `db:"id"`
+		Username string `db:"username"`
+	}
+	err := db.Get(&account, "SELECT id, username FROM users WHERE email = ?", reset.Email)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			recordFailures(db, r, resetKey, reset.Email)
+			http.Error(w, "Invalid or expired code", http.StatusBadRequest)
+			return
+		}
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	err = consumeOneTimeCode(tx, account.ID, PURPOSE_PASSWORD_RESET, reset.Otp)
+	if err != nil {
+		if errors.Is(err, errCodeInvalid) || errors.Is(err, errCodeAttempts) {
+			// The attempt counter has to be saved even though the reset failed
+			if err := tx.Commit(); err != nil {
+				log.Println(err)
+			}
+			recordFailures(db, r, resetKey, account.Username)
+			http.Error(w, "Invalid or expired code", http.StatusBadRequest)
+			return
+		}
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	// Only hashed once the code is good, a wrong guess costs no bcrypt
+	hashPassword, err := bcrypt.GenerateFromPassword([]byte(reset.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Hash Error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := updatePassword(tx, string(hashPassword), account.ID); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	clearFailures(db, resetKey)
+	auditlog.Record(db, auditlog.AuditLog{
+		UserName: account.Username,
+		Action:   "password_reset",
+		Target:   "password",
+		Metadata: map[string]string{
+			"ip": clientIP(r),
+		},
+	})
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("Password Updated \n"))
+}
+
+// storeOneTimeCode replaces any previous code of the same purpose
+func storeOneTimeCode(db sqlx.Execer, userID int, purpose string, otp string, ttl time.Duration) error {
+	now := time.Now()
+	_, err := db.Exec(`
+		INSERT INTO one_time_codes (user_id, purpose, code_hash, attempts, consumed, expires_at, created_at)
+		VALUES (?, ?, ?, 0, FALSE, ?, ?)
+		ON CONFLICT(user_id, purpose) DO UPDATE SET
+			code_hash = excluded.code_hash,
+			attempts = 0,
+			consumed = FALSE,
+			expires_at = excluded.expires_at,
+			created_at = excluded.created_at
+	`, userID, purpose, HashOTP(otp), now.Add(ttl), now)
+	return err
+}
+
+// consumeOneTimeCode checks otp against the live code of the purpose and
+// marks it consumed. Wrong guesses are counted, the code is dead after
+// ONE_TIME_CODE_MAX_ATTEMPTS of them.
+func consumeOneTimeCode(tx *sqlx.Tx, userID int, purpose string, otp string) error {
+	var code struct {
+		ID        int       `db:"id"`
+		CodeHash  string    `db:"code_hash"`
+		Attempts  int       `db:"attempts"`
+		Consumed  bool      `db:"consumed"`
+		ExpiresAt time.Time `db:"expires_at"`
+	}
+	err := tx.Get(&code, `
+		SELECT id, code_hash, attempts, consumed, expires_at
+		FROM one_time_codes
+		WHERE user_id = ? AND purpose = ?`, userID, purpose)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errCodeInvalid
+		}
+		return err
+	}
+	if code.Consumed || time.Now().After(code.ExpiresAt) {
+		return errCodeInvalid
+	}
+	if code.Attempts >= ONE_TIME_CODE_MAX_ATTEMPTS {
+		return errCodeAttempts
+	}
+
+	if subtle.ConstantTimeCompare([]byte(code.CodeHash), []byte(HashOTP(otp))) != 1 {
+		if _, err := tx.Exec("UPDATE one_time_codes SET attempts = attempts + 1 WHERE id = ?", code.ID); err != nil {
+			return err
+		}
+		return errCodeInvalid
+	}
+
+	res, err := tx.Exec("UPDATE one_time_codes SET consumed = TRUE WHERE id = ? AND consumed = FALSE", code.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errCodeInvalid
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package user
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"pingless/internal/events"
+	"pingless/internal/presence"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+NOTE : This file deal with presence and custom status
+
+Presence (online/idle/dnd/invisible) is kept in memory by the presence
+package and refreshed by the heartbeat endpoint. The custom status is a short
+text next to the bio, stored in users with an optional expiry. An expired
+status is simply not shown, it stays in the row until replaced.
+*/
+
+const (
+	MAX_CUSTOM_STATUS_SIZE     = 128
+	MAX_CUSTOM_STATUS_LIFETIME = 30 * 24 * time.Hour
+	MAX_PRESENCE_LOOKUP        = 100
+)
+
+func PresenceHeartbeat(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var heartbeat PresenceHeartbeatModel
+	if err := json.NewDecoder(r.Body).Decode(&heartbeat); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if heartbeat.Status != "" && !slices.Contains(presence.STATUSES, heartbeat.Status) {
+		http.Error(w, "Status must be one of online, idle, dnd, invisible", http.StatusBadRequest)
+		return
+	}
+
+	status := presence.Heartbeat(username, heartbeat.Status)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":             status,
+		"heartbeat_interval": presence.HEARTBEAT_INTERVAL.Milliseconds(),
+	})
+}
+
+func SetCustomStatus(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var status CustomStatusModel
+	if err := json.NewDecoder(r.Body).Decode(&status); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	status.Text = strings.TrimSpace(status.Text)
+	if utf8.RuneCountInString(status.Text) > MAX_CUSTOM_STATUS_SIZE {
+		http.Error(w, "Status can be at most 128 characters", http.StatusBadRequest)
+		return
+	}
+	if status.ExpiresIn < 0 || time.Duration(status.ExpiresIn)*time.Second > MAX_CUSTOM_STATUS_LIFETIME {
+		http.Error(w, "Status can last at most 30 days", http.StatusBadRequest)
+		return
+	}
+
+	var expiresAt *time.Time
+	if status.ExpiresIn > 0 && status.Text != "" {
+		t := time.Now().Add(time.Duration(status.ExpiresIn) * time.Second)
+		expiresAt = &t
+	}
+	_, err := db.Exec("UPDATE users SET custom_status = ?, custom_status_expires_at = ? WHERE username = ?", status.Text, expiresAt, username)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	custom := CustomStatusResponse{Text: status.Text, ExpiresAt: expiresAt}
+	events.PublishUserUpdate(db, events.UserUpdate{
+		Username:     username,
+		CustomStatus: &events.CustomStatus{Text: custom.Text, ExpiresAt: custom.ExpiresAt},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(custom)
+}
+
+// GetPresence takes one or more username query parameters, unknown users
+// and users who blocked the requester are left out of the answer
+func GetPresence(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	requester, _ := claims["username"].(string)
+
+	usernames := r.URL.Query()["username"]
+	if len(usernames) == 0 {
+		http.Error(w, "Username required", http.StatusBadRequest)
+		return
+	}
+	if len(usernames) > MAX_PRESENCE_LOOKUP {
+		http.Error(w, "At most 100 usernames", http.StatusBadRequest)
+		return
+	}
+
+	query, args, err := sqlx.In(`
+		SELECT username, custom_status, custom_status_expires_at
+		FROM users WHERE username IN (?)
+		ORDER BY username`, usernames)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	var rows []customStatusRow
+	if err := db.Select(&rows, query, args...); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	response := []PresenceResponse{}
+	for _, row := range rows {
+		blocked, err := HasBlocked(db, row.Username, requester)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "DB ERROR", http.StatusInternalServerError)
+			return
+		}
+		if blocked {
+			continue
+		}
+		response = append(response, row.presence(requester))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+type customStatusRow struct {
+	Username  string     `db:"username"`
+	Text      string     `db:"custom_status"`
+	ExpiresAt *time.Time `db:"custom_status_expires_at"`
+}
+
+// presence is what requester is shown of row, users see their own
+// invisible status
+func (row customStatusRow) presence(requester string) PresenceResponse {
+	response := PresenceResponse{Username: row.Username, Presence: presence.Visible(row.Username)}
+	if row.Username == requester {
+		response.Presence = presence.Get(row.Username)
+	}
+	if row.Text != "" && (row.ExpiresAt == nil || time.Now().Before(*row.ExpiresAt)) {
+		response.CustomStatus = &CustomStatusResponse{Text: row.Text, ExpiresAt: row.ExpiresAt}
+	}
+	return response
+}
@@ -1,26 +1,47 @@
 package user
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	_ "image/jpeg"
 	_ "image/png"
 	"log"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strings"
+	"time"
+	_ "time/tzdata" // timezones without the system database
+	"unicode/utf8"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/jmoiron/sqlx"
+	"pingless/internal/events"
 	"pingless/internal/fileutil"
+	"pingless/routes/role"
 )
 
 /*
 NOTE : This file is contains endpoint for All the Profile Options
 
+Text limits count characters, not bytes.
+
 TODO:
 [ ] Delete Profile picture if it already exist
 */
 const MAX_BIO_SIZE int = 200
 
+const (
+	MAX_DISPLAY_NAME_SIZE = 32
+	MAX_PRONOUNS_SIZE     = 40
+	MAX_LINKS             = 5
+	MAX_LINK_SIZE         = 256
+)
+
+var accentColor = regexp.MustCompile(`^#[0-9A-Fa-f]{6}$`)
+
 func UpdatePfp(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
 	config := fileutil.NewFileUploadConfig(
 		"pfp",
@@ -98,7 +119,7 @@ func UpdateBio(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
 	}
 
 	bio.Bio = strings.Trim(bio.Bio, " ") // trim whitespace
-	if len(bio.Bio) > MAX_BIO_SIZE {
+	if utf8.RuneCountInString(bio.Bio) > MAX_BIO_SIZE {
 		http.Error(w, "Max length exceded", http.StatusBadRequest)
 		return
 	}
@@ -109,7 +130,292 @@ func UpdateBio(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
 		return
 	}
 
+	events.PublishUserUpdate(db, events.UserUpdate{Username: username, Bio: &bio.Bio})
+
 	//Response
 	w.WriteHeader(http.StatusAccepted)
 	w.Write([]byte("Bio Updated\n"))
 }
+
+// UpdateProfile changes the given fields together, nothing is changed when
+// one of them is invalid
+func UpdateProfile(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var update UpdateProfileModel
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	sets := []string{}
+	args := []any{}
+	text := func(field *string, column string, max int) bool {
+		if field == nil {
+			return true
+		}
+		*field = strings.TrimSpace(*field)
+		if utf8.RuneCountInString(*field) > max {
+			http.Error(w, fmt.Sprintf("%s can be at most %d characters", column, max), http.StatusBadRequest)
+			return false
+		}
+		sets = append(sets, column+" = ?")
+		args = append(args, *field)
+		return true
+	}
+	if !text(update.Bio, "bio", MAX_BIO_SIZE) ||
+		!text(update.DisplayName, "display_name", MAX_DISPLAY_NAME_SIZE) ||
+		!text(update.Pronouns, "pronouns", MAX_PRONOUNS_SIZE) {
+		return
+	}
+
+	if update.AccentColor != nil {
+		*update.AccentColor = strings.ToUpper(strings.TrimSpace(*update.AccentColor))
+		if *update.AccentColor != "" && !accentColor.MatchString(*update.AccentColor) {
+			http.Error(w, "accent_color must be #RRGGBB", http.StatusBadRequest)
+			return
+		}
+		sets = append(sets, "accent_color = ?")
+		args = append(args, *update.AccentColor)
+	}
+
+	if update.Timezone != nil {
+		*update.Timezone = strings.TrimSpace(*update.Timezone)
+		if *update.Timezone != "" {
+			// "Local" would be the timezone of the server
+			if _, err := time.LoadLocation(*update.Timezone); err != nil || *update.Timezone == "Local" {
+				http.Error(w, "Unknown timezone", http.StatusBadRequest)
+				return
+			}
+		}
+		sets = append(sets, "timezone = ?")
+		args = append(args, *update.Timezone)
+	}
+
+	if update.Links != nil {
+		if len(*update.Links) > MAX_LINKS {
+			http.Error(w, fmt.Sprintf("At most %d links", MAX_LINKS), http.StatusBadRequest)
+			return
+		}
+		links := []string{}
+		for _, link := range *update.Links {
+			link = strings.TrimSpace(link)
+			if !validLink(link) {
+				http.Error(w, "Links must be http(s) urls of at most 256 characters", http.StatusBadRequest)
+				return
+			}
+			links = append(links, link)
+		}
+		encoded, _ := json.Marshal(links)
+		update.Links = &links
+		sets = append(sets, "links = ?")
+		args = append(args, string(encoded))
+		// Only the urls that stay keep their verification
+		sets = append(sets, `verified_links = (
+			SELECT json_group_array(v.value) FROM json_each(verified_links) v
+			WHERE v.value IN (SELECT value FROM json_each(?)))`)
+		args = append(args, string(encoded))
+	}
+
+	if len(sets) == 0 {
+		http.Error(w, "Nothing to update", http.StatusBadRequest)
+		return
+	}
+
+	_, err := db.Exec("UPDATE users SET "+strings.Join(sets, ", ")+" WHERE username = ?", append(args, username)...)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	profile, err := loadProfile(db, username, username)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	userUpdate := events.UserUpdate{
+		Username:    username,
+		Bio:         update.Bio,
+		DisplayName: update.DisplayName,
+		Pronouns:    update.Pronouns,
+		AccentColor: update.AccentColor,
+		Timezone:    update.Timezone,
+		Links:       update.Links,
+	}
+	if update.Links != nil {
+		userUpdate.VerifiedLinks = &profile.VerifiedLinks
+	}
+	events.PublishUserUpdate(db, userUpdate)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profile)
+}
+
+func validLink(link string) bool {
+	if utf8.RuneCountInString(link) > MAX_LINK_SIZE {
+		return false
+	}
+	u, err := url.Parse(link)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && u.User == nil
+}
+
+// GetProfile returns the public profile of ?username=, a user who blocked the
+// requester is not found
+func GetProfile(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	requester, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	username := r.URL.Query().Get("username")
+	if username == "" {
+		http.Error(w, "Username required", http.StatusBadRequest)
+		return
+	}
+	blocked, err := HasBlocked(db, username, requester)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if blocked {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	profile, err := loadProfile(db, username, requester)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profile)
+}
+
+// GetMe returns the profile of the requester with the private parts
+func GetMe(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	profile, err := loadProfile(db, username, username)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	me := MeResponse{ProfileResponse: profile, Settings: AccountSettings{LinkedProviders: []string{}}}
+
+	err = db.Get(&me.Email, "SELECT email FROM users WHERE username = ?", username)
+	if err == nil {
+		err = db.Get(&me.Settings.TwoFactorEnabled, `
+			SELECT EXISTS(SELECT 1 FROM user_mfa m JOIN users u ON m.user_id = u.id WHERE u.username = ? AND m.enabled)`, username)
+	}
+	if err == nil {
+		err = db.Select(&me.Settings.LinkedProviders, `
+			SELECT i.issuer FROM user_identities i
+			JOIN users u ON i.user_id = u.id
+			WHERE u.username = ?
+			ORDER BY i.issuer`, username)
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(me)
+}
+
+// loadProfile returns the profile of username as requester sees it
+func loadProfile(db *sqlx.DB, username string, requester string) (ProfileResponse, error) {
+	var profile ProfileResponse
+	var status customStatusRow
+	var links, verifiedLinks string
+	var id int
+	row := db.QueryRowx(`
+		SELECT u.id, u.username, u.display_name, COALESCE(u.bio, '') AS bio, u.pronouns, u.accent_color, u.timezone, u.links,
+			u.verified_links, u.created_at, u.custom_status, u.custom_status_expires_at
+		FROM users u
+		WHERE u.username = ?`, username)
+	err := row.Scan(&id, &profile.Username, &profile.DisplayName, &profile.Bio, &profile.Pronouns, &profile.AccentColor, &profile.Timezone, &links,
+		&verifiedLinks, &profile.JoinedAt, &status.Text, &status.ExpiresAt)
+	if err != nil {
+		return profile, err
+	}
+	roles, err := role.UserRoles(db, id)
+	if err != nil {
+		return profile, err
+	}
+	profile.Role, profile.Roles, profile.Color = roles[id].Top, roles[id].IDs, roles[id].Color
+	if err := json.Unmarshal([]byte(links), &profile.Links); err != nil {
+		return profile, err
+	}
+	if err := json.Unmarshal([]byte(verifiedLinks), &profile.VerifiedLinks); err != nil {
+		return profile, err
+	}
+	status.Username = profile.Username
+	presence := status.presence(requester)
+	profile.Presence = presence.Presence
+	profile.CustomStatus = presence.CustomStatus
+
+	var images []struct {
+		ImageType string `db:"image_type"`
+		FileName  string `db:"file_name"`
+	}
+	err = db.Select(&images, `
+		SELECT i.image_type, i.file_name
+		FROM images i
+		JOIN users u ON i.user_id = u.id
+		WHERE u.username = ?`, username)
+	if err != nil {
+		return profile, err
+	}
+	for _, img := range images {
+		url := "/images/" + img.FileName
+		switch img.ImageType {
+		case "pfp":
+			profile.Pfp = &url
+		case "banner":
+			profile.Banner = &url
+		}
+	}
+	return profile, nil
+}
@@ -0,0 +1,220 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"pingless/internal/auditlog"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+NOTE : This file deal with refresh token rotation
+
+Refresh tokens are opaque random strings, only their sha256 is stored.
+Each token can be used exactly once: using it marks it as rotated and
+hands out a new one from the same family. Presenting a rotated token
+again means it was stolen (or replayed), so the whole family is revoked
+and the user has to log in again.
+*/
+
+const REFRESH_TOKEN_TTL = (time.Hour * 24) * 30
+
+func RefreshToken(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	cookie, err := r.Cookie("refresh_token")
+	if err != nil || cookie.Value == "" {
+		http.Error(w, "Missing refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	var stored refreshTokenRow
+	err = db.Get(&stored, `
+		SELECT t.id, t.user_id, t.family_id, t.rotated, t.revoked, t.expires_at,
+			COALESCE(s.revoked, TRUE) AS session_revoked, COALESCE(s.mfa, FALSE) AS session_mfa
+		FROM refresh_tokens t
+		LEFT JOIN sessions s ON t.family_id = s.id
+		WHERE t.token_hash = ?`, hashToken(cookie.Value))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	if stored.Revoked || stored.SessionRevoked {
+		clearRefreshCookie(w)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if stored.Rotated {
+		handleRefreshTokenReuse(w, db, stored)
+		return
+	}
+	if time.Now().After(stored.ExpiresAt) {
+		clearRefreshCookie(w)
+		http.Error(w, "Refresh token expired", http.StatusUnauthorized)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Only one request can win the rotation, a concurrent replay of the
+	// same token sees zero affected rows and is treated as reuse.
+	res, err := tx.Exec(`UPDATE refresh_tokens SET rotated = TRUE WHERE id = ? AND rotated = FALSE`, stored.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		tx.Rollback()
+		handleRefreshTokenReuse(w, db, stored)
+		return
+	}
+
+	newToken, err := issueRefreshToken(tx, stored.UserID, stored.FamilyID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	var username string
+	if err := tx.Get(&username, "SELECT username FROM users WHERE id = ?", stored.UserID); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE sessions SET last_seen_at = ?, ip = ? WHERE id = ?", time.Now(), clientIP(r), stored.FamilyID); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	accessToken, err := createAccessToken(db, username, stored.FamilyID, stored.SessionMfa)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "JWT ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	setRefreshCookie(w, newToken)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": accessToken,
+	})
+}
+
+func handleRefreshTokenReuse(w http.ResponseWriter, db *sqlx.DB, stored refreshTokenRow) {
+	if err := revokeTokenFamily(db, stored.FamilyID); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	var username string
+	if err := db.Get(&username, "SELECT username FROM users WHERE id = ?", stored.UserID); err != nil {
+		log.Println(err)
+	}
+	log.Printf("Refresh token reuse detected for user %s, family %s revoked", username, stored.FamilyID)
+	auditlog.Record(db, auditlog.AuditLog{
+		UserName: username,
+		Action:   "refresh_token_reuse",
+		Target:   "refresh_token",
+		Metadata: map[string]string{
+			"family_id": stored.FamilyID,
+			"token_id":  strconv.Itoa(stored.ID),
+		},
+	})
+
+	clearRefreshCookie(w)
+	http.Error(w, "Refresh token reuse detected", http.StatusUnauthorized)
+}
+
+// revokeTokenFamily also revokes the session the family belongs to, so the
+// access tokens already handed out stop working too.
+func revokeTokenFamily(db *sqlx.DB, familyID string) error {
+	_, err := db.Exec("UPDATE refresh_tokens SET revoked = TRUE WHERE family_id = ?", familyID)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE sessions SET revoked = TRUE WHERE id = ?", familyID)
+	return err
+}
+
+// issueRefreshToken stores a new token of the given family and returns the
+// plaintext value, which is only ever sent to the client.
+func issueRefreshToken(db sqlx.Execer, userID int, familyID string) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	_, err = db.Exec(`
+		INSERT INTO refresh_tokens (user_id, token_hash, family_id, expires_at)
+		VALUES (?, ?, ?, ?)`,
+		userID, hashToken(token), familyID, time.Now().Add(REFRESH_TOKEN_TTL),
+	)
+	return token, err
+}
+
+// TODO : use secure in production
+func setRefreshCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "refresh_token",
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(REFRESH_TOKEN_TTL.Seconds()),
+	})
+}
+
+func clearRefreshCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "refresh_token",
+		Value:    "",
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   -1,
+	})
+}
+
+func randomToken(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,98 @@
+package user
+
+import (
+	"database/sql"
+	"errors"
+	"pingless/internal/signing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+NOTE : This file deal with registration tickets
+
+A verified email alone does not allow to register, whoever completed the
+otp gets a ticket for that email and create_user / create_owner need it.
+A ticket is a signed token whose jti is stored in registration_tickets, it
+is good for one registration only. It is signed with the access token key,
+its typ and aud of "registration" keep it from being taken for one.
+*/
+
+const REGISTRATION_TICKET_TTL = 30 * time.Minute
+
+const REGISTRATION_TOKEN_TYPE = "registration"
+
+var ErrInvalidTicket = errors.New("invalid or expired registration ticket")
+
+func issueRegistrationTicket(db *sqlx.DB, email string) (string, error) {
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	expiresAt := now.Add(REGISTRATION_TICKET_TTL)
+	_, err = db.Exec("INSERT INTO registration_tickets (jti, email, expires_at) VALUES (?, ?, ?)", jti, email, expiresAt)
+	if err != nil {
+		return "", err
+	}
+	return signing.Sign(db, jwt.MapClaims{
+		"typ":   REGISTRATION_TOKEN_TYPE,
+		"aud":   REGISTRATION_TOKEN_TYPE,
+		"email": email,
+		"jti":   jti,
+		"iat":   now.Unix(),
+		"exp":   expiresAt.Unix(),
+	})
+}
+
+// ConsumeRegistrationTicket checks that ticket was issued for email and uses
+// it up inside tx. The email verification row is removed with it, once an
+// email belongs to a user it cannot be verified again.
+func ConsumeRegistrationTicket(db *sqlx.DB, tx *sqlx.Tx, ticket string, email string) error {
+	if ticket == "" {
+		return ErrInvalidTicket
+	}
+	token, err := signing.Parse(db, ticket, jwt.WithExpirationRequired(), jwt.WithAudience(REGISTRATION_TOKEN_TYPE))
+	if err != nil {
+		return ErrInvalidTicket
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["typ"] != REGISTRATION_TOKEN_TYPE || claims["email"] != email {
+		return ErrInvalidTicket
+	}
+	jti, _ := claims["jti"].(string)
+
+	var stored struct {
+		Email     string    `db:"email"`
+		ExpiresAt time.Time `db:"expires_at"`
+		Consumed  bool      `db:"consumed"`
+	}
+	err = tx.Get(&stored, "SELECT email, expires_at, consumed FROM registration_tickets WHERE jti = ?", jti)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidTicket
+		}
+		return err
+	}
+	if stored.Consumed || stored.Email != email || time.Now().After(stored.ExpiresAt) {
+		return ErrInvalidTicket
+	}
+
+	res, err := tx.Exec("UPDATE registration_tickets SET consumed = TRUE WHERE jti = ? AND consumed = FALSE", jti)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrInvalidTicket
+	}
+	_, err = tx.Exec("DELETE FROM email_verifications WHERE email = ?", email)
+	return err
+}
+
+func isEmailRegistered(db *sqlx.DB, email string) (bool, error) {
+	var exists bool
+	err := db.Get(&exists, "SELECT EXISTS(SELECT 1 FROM users WHERE email = ?)", email)
+	return exists, err
+}
@@ -0,0 +1,427 @@
+package user
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"pingless/internal/events"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+NOTE : This file deal with friends and blocks
+
+Every call answers with the relationship it leads to, as the requester sees
+it: none, outgoing, incoming, friend or blocked. Calls are idempotent, asking
+for a state that already holds just returns it. Sending a request to someone
+who already asked you makes you friends.
+
+Blocking removes any friendship or request between the two. A blocked user
+cannot send requests to, or message, the blocker and does not get their
+images, presence or profile updates. The blocked user is never told, for
+them the relationship is none.
+
+Lists are ordered by username, after=<last username> gives the next page.
+*/
+
+const (
+	MAX_OUTGOING_REQUESTS        = 100
+	DEFAULT_RELATIONSHIPS_LIMIT  = 50
+	MAX_RELATIONSHIPS_LIMIT      = 100
+	RELATIONSHIP_PENDING         = "pending"
+	RELATIONSHIP_FRIEND          = "friend"
+	RELATIONSHIP_STATUS_NONE     = "none"
+	RELATIONSHIP_STATUS_OUTGOING = "outgoing"
+	RELATIONSHIP_STATUS_INCOMING = "incoming"
+	RELATIONSHIP_STATUS_FRIEND   = "friend"
+	RELATIONSHIP_STATUS_BLOCKED  = "blocked"
+)
+
+var (
+	errCannotRequest   = errors.New("cannot send a friend request")
+	errTooManyRequests = errors.New("too many outgoing friend requests")
+)
+
+type relationshipParties struct {
+	me, them         int
+	meName, themName string
+}
+
+// relationshipChange runs change in a transaction between the requester and
+// the username of the body, then answers with the resulting status and tells
+// both sides
+func relationshipChange(w http.ResponseWriter, r *http.Request, db *sqlx.DB, change func(tx *sqlx.Tx, p relationshipParties) error) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var target RelationshipModel
+	if err := json.NewDecoder(r.Body).Decode(&target); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	target.Username = strings.TrimSpace(target.Username)
+	if target.Username == username {
+		http.Error(w, "That is you", http.StatusBadRequest)
+		return
+	}
+
+	p := relationshipParties{meName: username, themName: target.Username}
+	if err := db.Get(&p.me, "SELECT id FROM users WHERE username = ?", username); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if err := db.Get(&p.them, "SELECT id FROM users WHERE username = ?", target.Username); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	before, err := relationshipStatus(tx, p.me, p.them)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	theirsBefore, err := relationshipStatus(tx, p.them, p.me)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if err := change(tx, p); err != nil {
+		switch {
+		case errors.Is(err, errCannotRequest):
+			http.Error(w, "Cannot send a friend request to this user", http.StatusForbidden)
+		case errors.Is(err, errTooManyRequests):
+			http.Error(w, fmt.Sprintf("At most %d pending friend requests", MAX_OUTGOING_REQUESTS), http.StatusBadRequest)
+		case errors.Is(err, sql.ErrNoRows):
+			http.Error(w, "No friend request from this user", http.StatusNotFound)
+		default:
+			log.Println(err)
+			http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		}
+		return
+	}
+	after, err := relationshipStatus(tx, p.me, p.them)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	theirs, err := relationshipStatus(tx, p.them, p.me)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	// Each side is told only when its own view changes, so a block reaches
+	// the blocked user as none
+	if after != before {
+		events.PublishTo(db, []string{p.meName}, events.RELATIONSHIP_UPDATE, events.RelationshipUpdate{Username: p.themName, Status: after})
+	}
+	if theirs != theirsBefore {
+		events.PublishTo(db, []string{p.themName}, events.RELATIONSHIP_UPDATE, events.RelationshipUpdate{Username: p.meName, Status: theirs})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RelationshipResponse{Username: p.themName, Status: after})
+}
+
+// relationshipStatus is the relationship of me with them as me sees it
+func relationshipStatus(tx *sqlx.Tx, me int, them int) (string, error) {
+	var blocked bool
+	if err := tx.Get(&blocked, "SELECT EXISTS(SELECT 1 FROM blocks WHERE blocker_id = ? AND blocked_id = ?)", me, them); err != nil {
+		return "", err
+	}
+	if blocked {
+		return RELATIONSHIP_STATUS_BLOCKED, nil
+	}
+	var rows []struct {
+		UserID int    `db:"user_id"`
+		Type   string `db:"type"`
+	}
+	err := tx.Select(&rows, `
+		SELECT user_id, type FROM relationships
+		WHERE (user_id = ? AND target_id = ?) OR (user_id = ? AND target_id = ?)`, me, them, them, me)
+	if err != nil {
+		return "", err
+	}
+	status := RELATIONSHIP_STATUS_NONE
+	for _, row := range rows {
+		switch {
+		case row.Type == RELATIONSHIP_FRIEND:
+			return RELATIONSHIP_STATUS_FRIEND, nil
+		case row.UserID == me:
+			status = RELATIONSHIP_STATUS_OUTGOING
+		default:
+			status = RELATIONSHIP_STATUS_INCOMING
+		}
+	}
+	return status, nil
+}
+
+func makeFriends(tx *sqlx.Tx, a int, b int) error {
+	if _, err := tx.Exec("DELETE FROM relationships WHERE (user_id = ? AND target_id = ?) OR (user_id = ? AND target_id = ?)", a, b, b, a); err != nil {
+		return err
+	}
+	now := time.Now()
+	_, err := tx.Exec("INSERT INTO relationships (user_id, target_id, type, created_at) VALUES (?, ?, ?, ?), (?, ?, ?, ?)",
+		a, b, RELATIONSHIP_FRIEND, now, b, a, RELATIONSHIP_FRIEND, now)
+	return err
+}
+
+func SendFriendRequest(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	relationshipChange(w, r, db, func(tx *sqlx.Tx, p relationshipParties) error {
+		var blocked bool
+		err := tx.Get(&blocked, `
+			SELECT EXISTS(SELECT 1 FROM blocks
+			WHERE (blocker_id = ? AND blocked_id = ?) OR (blocker_id = ? AND blocked_id = ?))`,
+			p.me, p.them, p.them, p.me)
+		if err != nil {
+			return err
+		}
+		if blocked {
+			return errCannotRequest
+		}
+
+		status, err := relationshipStatus(tx, p.me, p.them)
+		if err != nil {
+			return err
+		}
+		switch status {
+		case RELATIONSHIP_STATUS_INCOMING:
+			return makeFriends(tx, p.me, p.them)
+		case RELATIONSHIP_STATUS_NONE:
+			var pending int
+			if err := tx.Get(&pending, "SELECT COUNT(*) FROM relationships WHERE user_id = ? AND type = ?", p.me, RELATIONSHIP_PENDING); err != nil {
+				return err
+			}
+			if pending >= MAX_OUTGOING_REQUESTS {
+				return errTooManyRequests
+			}
+			_, err := tx.Exec("INSERT INTO relationships (user_id, target_id, type, created_at) VALUES (?, ?, ?, ?)",
+				p.me, p.them, RELATIONSHIP_PENDING, time.Now())
+			return err
+		}
+		return nil
+	})
+}
+
+func AcceptFriendRequest(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	relationshipChange(w, r, db, func(tx *sqlx.Tx, p relationshipParties) error {
+		status, err := relationshipStatus(tx, p.me, p.them)
+		if err != nil {
+			return err
+		}
+		switch status {
+		case RELATIONSHIP_STATUS_FRIEND:
+			return nil
+		case RELATIONSHIP_STATUS_INCOMING:
+			return makeFriends(tx, p.me, p.them)
+		}
+		return sql.ErrNoRows
+	})
+}
+
+func DeclineFriendRequest(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	relationshipChange(w, r, db, func(tx *sqlx.Tx, p relationshipParties) error {
+		_, err := tx.Exec("DELETE FROM relationships WHERE user_id = ? AND target_id = ? AND type = ?", p.them, p.me, RELATIONSHIP_PENDING)
+		return err
+	})
+}
+
+func CancelFriendRequest(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	relationshipChange(w, r, db, func(tx *sqlx.Tx, p relationshipParties) error {
+		_, err := tx.Exec("DELETE FROM relationships WHERE user_id = ? AND target_id = ? AND type = ?", p.me, p.them, RELATIONSHIP_PENDING)
+		return err
+	})
+}
+
+func RemoveFriend(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	relationshipChange(w, r, db, func(tx *sqlx.Tx, p relationshipParties) error {
+		_, err := tx.Exec(`
+			DELETE FROM relationships
+			WHERE type = ? AND ((user_id = ? AND target_id = ?) OR (user_id = ? AND target_id = ?))`,
+			RELATIONSHIP_FRIEND, p.me, p.them, p.them, p.me)
+		return err
+	})
+}
+
+func BlockUser(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	relationshipChange(w, r, db, func(tx *sqlx.Tx, p relationshipParties) error {
+		_, err := tx.Exec("DELETE FROM relationships WHERE (user_id = ? AND target_id = ?) OR (user_id = ? AND target_id = ?)", p.me, p.them, p.them, p.me)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			INSERT INTO blocks (blocker_id, blocked_id, created_at) VALUES (?, ?, ?)
+			ON CONFLICT(blocker_id, blocked_id) DO NOTHING`, p.me, p.them, time.Now())
+		return err
+	})
+}
+
+func UnblockUser(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	relationshipChange(w, r, db, func(tx *sqlx.Tx, p relationshipParties) error {
+		_, err := tx.Exec("DELETE FROM blocks WHERE blocker_id = ? AND blocked_id = ?", p.me, p.them)
+		return err
+	})
+}
+
+func ListFriends(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	listRelationships(w, r, db, `
+		SELECT u.username, r.created_at
+		FROM relationships r
+		JOIN users u ON r.target_id = u.id
+		WHERE r.user_id = ? AND r.type = 'friend' AND u.username > ?
+		ORDER BY u.username
+		LIMIT ?`)
+}
+
+// ListFriendRequests takes direction=incoming (default) or outgoing
+func ListFriendRequests(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	switch r.URL.Query().Get("direction") {
+	case "", RELATIONSHIP_STATUS_INCOMING:
+		listRelationships(w, r, db, `
+			SELECT u.username, r.created_at
+			FROM relationships r
+			JOIN users u ON r.user_id = u.id
+			WHERE r.target_id = ? AND r.type = 'pending' AND u.username > ?
+			ORDER BY u.username
+			LIMIT ?`)
+	case RELATIONSHIP_STATUS_OUTGOING:
+		listRelationships(w, r, db, `
+			SELECT u.username, r.created_at
+			FROM relationships r
+			JOIN users u ON r.target_id = u.id
+			WHERE r.user_id = ? AND r.type = 'pending' AND u.username > ?
+			ORDER BY u.username
+			LIMIT ?`)
+	default:
+		http.Error(w, "direction must be incoming or outgoing", http.StatusBadRequest)
+	}
+}
+
+func ListBlocks(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	listRelationships(w, r, db, `
+		SELECT u.username, b.created_at
+		FROM blocks b
+		JOIN users u ON b.blocked_id = u.id
+		WHERE b.blocker_id = ? AND u.username > ?
+		ORDER BY u.username
+		LIMIT ?`)
+}
+
+// listRelationships runs query with the requester id, the after cursor and
+// the limit
+func listRelationships(w http.ResponseWriter, r *http.Request, db *sqlx.DB, query string) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	limit := DEFAULT_RELATIONSHIPS_LIMIT
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		var err error
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > MAX_RELATIONSHIPS_LIMIT {
+			http.Error(w, "Allowed limit 1 ≤ limit ≤ 100", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var userID int
+	if err := db.Get(&userID, "SELECT id FROM users WHERE username = ?", username); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	list := []RelationshipListResponse{}
+	if err := db.Select(&list, query, userID, r.URL.Query().Get("after"), limit); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// HasBlocked reports whether blocker blocked blocked, by username
+func HasBlocked(db *sqlx.DB, blocker string, blocked string) (bool, error) {
+	var exists bool
+	err := db.Get(&exists, `
+		SELECT EXISTS(
+			SELECT 1 FROM blocks b
+			JOIN users a ON b.blocker_id = a.id
+			JOIN users t ON b.blocked_id = t.id
+			WHERE a.username = ? AND t.username = ?)`, blocker, blocked)
+	return exists, err
+}
+
+// Blocked reports whether either user blocked the other
+func Blocked(db *sqlx.DB, a string, b string) (bool, error) {
+	blocked, err := HasBlocked(db, a, b)
+	if err != nil || blocked {
+		return blocked, err
+	}
+	return HasBlocked(db, b, a)
+}
+
+// blockedViewer reports whether the caller was blocked by username. A request
+// without claims is treated as blocked, nobody anonymous sees user images.
+func blockedViewer(r *http.Request, db *sqlx.DB, username string) (bool, error) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		return true, nil
+	}
+	viewer, ok := claims["username"].(string)
+	if !ok {
+		return true, nil
+	}
+	return HasBlocked(db, username, viewer)
+}
@@ -0,0 +1,221 @@
+package user
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+NOTE : This file deal with per device sessions
+
+A session is created on every successful login and its id is carried in
+the "sid" claim of the access token. The session id doubles as the refresh
+token family, so revoking a session also revokes its refresh tokens.
+*/
+
+// How often last_seen_at is written back, to avoid a write on every request
+const SESSION_SEEN_INTERVAL = time.Minute
+
+func createSession(db sqlx.Execer, userID int, r *http.Request, mfa bool) (string, error) {
+	sessionID, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+	userAgent := r.UserAgent()
+	if len(userAgent) > 512 {
+		userAgent = userAgent[:512]
+	}
+	now := time.Now()
+	_, err = db.Exec(`
+		INSERT INTO sessions (id, user_id, user_agent, ip, mfa, created_at, last_seen_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		sessionID, userID, userAgent, clientIP(r), mfa, now, now,
+	)
+	return sessionID, err
+}
+
+// checkSession validates the session behind an access token and refreshes
+// its last_seen_at. issuedAt is the token's iat claim.
+func checkSession(db *sqlx.DB, r *http.Request, sessionID string, username string, issuedAt time.Time) (bool, error) {
+	var session struct {
+		Revoked           bool      `db:"revoked"`
+		LastSeenAt        time.Time `db:"last_seen_at"`
+		PasswordChangedAt int64     `db:"password_changed_at"`
+	}
+	err := db.Get(&session, `
+		SELECT s.revoked, s.last_seen_at, u.password_changed_at
+		FROM sessions s
+		JOIN users u ON s.user_id = u.id
+		WHERE s.id = ? AND u.username = ?`, sessionID, username)
+	if err != nil {
+		return false, err
+	}
+	if session.Revoked || issuedAt.Unix() < session.PasswordChangedAt {
+		return false, nil
+	}
+
+	if time.Since(session.LastSeenAt) > SESSION_SEEN_INTERVAL {
+		_, err = db.Exec("UPDATE sessions SET last_seen_at = ?, ip = ? WHERE id = ?", time.Now(), clientIP(r), sessionID)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	return true, nil
+}
+
+func revokeSession(db *sqlx.DB, userID int, sessionID string) (bool, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE sessions SET revoked = TRUE WHERE id = ? AND user_id = ?", sessionID, userID)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	if _, err := tx.Exec("UPDATE refresh_tokens SET revoked = TRUE WHERE family_id = ?", sessionID); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// revokeUserSessions revokes every session of the user except keepSessionID,
+// pass an empty string to revoke all of them.
+func revokeUserSessions(db sqlx.Execer, userID int, keepSessionID string) error {
+	_, err := db.Exec("UPDATE sessions SET revoked = TRUE WHERE user_id = ? AND id != ?", userID, keepSessionID)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE refresh_tokens SET revoked = TRUE WHERE user_id = ? AND family_id != ?", userID, keepSessionID)
+	return err
+}
+
+func ListSessions(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+	currentSession, _ := claims["sid"].(string)
+
+	var sessions []SessionResponse
+	err := db.Select(&sessions, `
+		SELECT s.id, s.user_agent, s.ip, s.created_at, s.last_seen_at
+		FROM sessions s
+		JOIN users u ON s.user_id = u.id
+		WHERE u.username = ? AND s.revoked = FALSE
+		ORDER BY s.last_seen_at DESC`, username)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == currentSession
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+func RevokeSession(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+
+	var revoke RevokeSessionModel
+	if err := json.NewDecoder(r.Body).Decode(&revoke); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	var userID int
+	if err := db.Get(&userID, "SELECT id FROM users WHERE username = ?", username); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	found, err := revokeSession(db, userID, revoke.SessionID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("Session Revoked\n"))
+}
+
+func RevokeOtherSessions(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
+	claims, ok := r.Context().Value("props").(jwt.MapClaims)
+	if !ok {
+		log.Println("Invalid token claims context")
+		http.Error(w, "Invalid token claims", http.StatusInternalServerError)
+		return
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		log.Println("username claim not a string")
+		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
+		return
+	}
+	currentSession, _ := claims["sid"].(string)
+
+	var userID int
+	if err := db.Get(&userID, "SELECT id FROM users WHERE username = ?", username); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if err := revokeUserSessions(tx, userID, currentSession); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("Other Sessions Revoked\n"))
+}
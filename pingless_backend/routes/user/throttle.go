@@ -0,0 +1,163 @@
+package user
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"pingless/internal/auditlog"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+NOTE : This file deal with brute force protection
+
+Failures are counted per key, a key is an account ("user:bob"), an email
+("email:bob@x.io") or an address ("ip:1.2.3.4"). Once a key has used up its
+free attempts every further failure locks it for twice as long as the one
+before, up to maxLockout. Failures older than THROTTLE_WINDOW are forgotten.
+*/
+
+const THROTTLE_WINDOW = time.Hour
+
+type throttlePolicy struct {
+	freeAttempts int
+	baseLockout  time.Duration
+	maxLockout   time.Duration
+}
+
+var (
+	// A single account or email gets few guesses
+	accountThrottle = throttlePolicy{freeAttempts: 5, baseLockout: 30 * time.Second, maxLockout: time.Hour}
+	// An address may be shared (NAT, office) so it gets more
+	ipThrottle = throttlePolicy{freeAttempts: 20, baseLockout: 30 * time.Second, maxLockout: time.Hour}
+)
+
+func throttleKey(kind string, value string) string {
+	return kind + ":" + value
+}
+
+// lockedFor returns how long the most restricted of keys is still locked
+func lockedFor(db *sqlx.DB, keys ...string) (time.Duration, error) {
+	var longest time.Duration
+	for _, key := range keys {
+		var lockedUntil sql.NullTime
+		err := db.Get(&lockedUntil, "SELECT locked_until FROM auth_throttle WHERE key = ?", key)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+			return 0, err
+		}
+		if lockedUntil.Valid {
+			if remaining := time.Until(lockedUntil.Time); remaining > longest {
+				longest = remaining
+			}
+		}
+	}
+	return longest, nil
+}
+
+// recordFailure counts a failed attempt for key and locks it when the policy
+// says so. Every lockout is written to the audit log with actor as user.
+func recordFailure(db *sqlx.DB, r *http.Request, key string, policy throttlePolicy, actor string) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	var state struct {
+		Failures    int       `db:"failures"`
+		LastFailure time.Time `db:"last_failure"`
+	}
+	err = tx.Get(&state, "SELECT failures, last_failure FROM auth_throttle WHERE key = ?", key)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if err == nil && now.Sub(state.LastFailure) > THROTTLE_WINDOW {
+		state.Failures = 0
+	}
+	state.Failures++
+
+	var lockedUntil sql.NullTime
+	var lockout time.Duration
+	if over := state.Failures - policy.freeAttempts; over > 0 {
+		lockout = policy.maxLockout
+		if over <= 20 {
+			lockout = min(policy.baseLockout<<(over-1), policy.maxLockout)
+		}
+		lockedUntil = sql.NullTime{Time: now.Add(lockout), Valid: true}
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO auth_throttle (key, failures, last_failure, locked_until)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(key) DO UPDATE SET
+			failures = excluded.failures,
+			last_failure = excluded.last_failure,
+			locked_until = excluded.locked_until
+	`, key, state.Failures, now, lockedUntil)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if lockedUntil.Valid {
+		log.Printf("Lockout of %s for %s after %d failures", key, lockout, state.Failures)
+		auditlog.Record(db, auditlog.AuditLog{
+			UserName: actor,
+			Action:   "auth_lockout",
+			Target:   key,
+			Metadata: map[string]string{
+				"failures": strconv.Itoa(state.Failures),
+				"until":    lockedUntil.Time.UTC().Format(time.RFC3339),
+				"ip":       clientIP(r),
+			},
+		})
+	}
+	return nil
+}
+
+// recordFailures is recordFailure for an account/email key and the ip key.
+// The ip is the one clientIP trusts, a forged X-Real-IP does not change it.
+func recordFailures(db *sqlx.DB, r *http.Request, accountKey string, actor string) {
+	if err := recordFailure(db, r, accountKey, accountThrottle, actor); err != nil {
+		log.Println(err)
+	}
+	if err := recordFailure(db, r, throttleKey("ip", clientIP(r)), ipThrottle, actor); err != nil {
+		log.Println(err)
+	}
+}
+
+// clearFailures is called on success. Only the account key is cleared, one
+// good login must not reset the counter of an address guessing many accounts.
+func clearFailures(db *sqlx.DB, accountKey string) {
+	if _, err := db.Exec("DELETE FROM auth_throttle WHERE key = ?", accountKey); err != nil {
+		log.Println(err)
+	}
+}
+
+// rejectIfLocked answers 429 and returns true when any of the keys is locked
+func rejectIfLocked(w http.ResponseWriter, db *sqlx.DB, keys ...string) bool {
+	remaining, err := lockedFor(db, keys...)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return true
+	}
+	if remaining <= 0 {
+		return false
+	}
+	seconds := int(remaining.Seconds()) + 1
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, fmt.Sprintf("Too many attempts, try again in %d seconds", seconds), http.StatusTooManyRequests)
+	return true
+}
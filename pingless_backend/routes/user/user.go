@@ -1,10 +1,17 @@
 package user
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
-	"os"
+	"pingless/internal/auditlog"
+	"pingless/internal/events"
+	"pingless/internal/permissions"
+	"pingless/internal/signing"
+	"pingless/routes/invite"
+	"strconv"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -21,21 +28,56 @@ func CreateUser(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
 		return
 	}
 
-	// Check if user is verified
-	var verified bool
-	err := db.QueryRow("SELECT verified FROM email_verifications WHERE email = ?", user.Email).Scan(&verified)
+	// Invite only servers can still be joined with an invite code
+	inviteOnly, err := isInviteOnly(db)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "DB ERROR", http.StatusInternalServerError)
 		return
 	}
+	if inviteOnly && user.InviteCode == "" {
+		http.Error(w, "Server is invite only", http.StatusUnauthorized)
+		return
+	}
 
-	if !verified {
+	tx, err := db.Beginx()
+	if err != nil {
 		log.Println(err)
-		http.Error(w, "UNAUTHORIZED", http.StatusBadRequest)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback()
 
+	// The ticket from otp_verification proves the email belongs to the caller
+	if err := ConsumeRegistrationTicket(db, tx, user.Ticket, user.Email); err != nil {
+		if errors.Is(err, ErrInvalidTicket) {
+			http.Error(w, "Invalid or expired registration ticket", http.StatusUnauthorized)
+			return
+		}
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	roleID := permissions.MEMBER_ROLE
+	if user.InviteCode != "" {
+		inviteRole, err := invite.Redeem(tx, user.InviteCode)
+		if err != nil {
+			if errors.Is(err, invite.ErrInvalidInvite) {
+				http.Error(w, "Invalid or expired invite", http.StatusBadRequest)
+				return
+			}
+			log.Println(err)
+			http.Error(w, "DB ERROR", http.StatusInternalServerError)
+			return
+		}
+		if inviteRole != nil {
+			roleID = *inviteRole
+		}
+	}
+
+	// Only hashed once the ticket and the invite are good, a forged ticket
+	// costs no bcrypt
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
 	if err != nil {
 		log.Println(err)
@@ -43,12 +85,31 @@ func CreateUser(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
 		return
 	}
 	user.Password = string(hashedPassword)
-	if err := insertUser(db, &user); err != nil {
+
+	if err := insertUser(tx, &user, roleID); err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
 		log.Println(err)
 		http.Error(w, "DB ERROR", http.StatusInternalServerError)
 		return
 	}
 
+	if user.InviteCode != "" {
+		auditlog.Record(db, auditlog.AuditLog{
+			UserName: user.Username,
+			Action:   "use_invite",
+			Target:   "invite",
+			Metadata: map[string]string{
+				"code":    user.InviteCode,
+				"role_id": strconv.Itoa(roleID),
+			},
+		})
+	}
+
+	events.Publish(db, events.USER_CREATE, events.UserCreate{Username: user.Username, CreatedAt: time.Now()})
 	w.WriteHeader(http.StatusCreated)
 	w.Write([]byte("User Created\n"))
 }
@@ -72,8 +133,9 @@ func ChangePassword(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
 		http.Error(w, "Invalid token payload", http.StatusUnauthorized)
 		return
 	}
+	var userID int
 	var storedHashPassword string
-	error := db.QueryRow("SELECT password_hash FROM users WHERE username = ?", username).Scan(&storedHashPassword)
+	error := db.QueryRow("SELECT id, password_hash FROM users WHERE username = ?", username).Scan(&userID, &storedHashPassword)
 	if error != nil {
 		log.Println(err)
 		http.Error(w, "DB ERROR", http.StatusBadRequest)
@@ -96,7 +158,19 @@ func ChangePassword(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
 		http.Error(w, "Hash Error", http.StatusInternalServerError)
 		return
 	}
-	if err := updatePassword(db, string(hashPassword), username); err != nil {
+	tx, txErr := db.Beginx()
+	if txErr != nil {
+		log.Println(txErr)
+		http.Error(w, "Database Error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if err := updatePassword(tx, string(hashPassword), userID); err != nil {
+		log.Println(err)
+		http.Error(w, "Database Error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
 		log.Println(err)
 		http.Error(w, "Database Error", http.StatusInternalServerError)
 		return
@@ -105,33 +179,52 @@ func ChangePassword(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
 	w.Write([]byte("Password Updated \n"))
 }
 
-func updatePassword(db *sqlx.DB, hashPassword string, username string) error {
-	_, err := db.Exec("UPDATE users SET password_hash =  ? WHERE username = ?", hashPassword, username)
-	return err
+// updatePassword stores the new hash and logs the user out everywhere,
+// access tokens issued before password_changed_at are rejected and personal
+// access tokens are revoked.
+// Callers should run it in a transaction.
+func updatePassword(db sqlx.Execer, hashPassword string, userID int) error {
+	_, err := db.Exec("UPDATE users SET password_hash =  ?, password_changed_at = ? WHERE id = ?", hashPassword, time.Now().Unix(), userID)
+	if err != nil {
+		return err
+	}
+	if err := revokeUserSessions(db, userID, ""); err != nil {
+		return err
+	}
+	return revokeUserAccessTokens(db, userID)
 }
 
-func insertUser(db *sqlx.DB, user *CreateUserModel) error {
-	_, err := db.Exec("INSERT INTO users (email,username,password_hash) VALUES (?,?,?)", user.Email, user.Username, user.Password)
+// insertUser creates the user with Member and roleID when it is another
+// role
+func insertUser(db sqlx.Execer, user *CreateUserModel, roleID int) error {
+	res, err := db.Exec("INSERT INTO users (email,username,password_hash) VALUES (?,?,?)", user.Email, user.Username, user.Password)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT OR IGNORE INTO user_roles (user_id, role_id) VALUES (?, ?), (?, ?)", id, permissions.MEMBER_ROLE, id, roleID)
 	return err
 }
-func createRefreshToken(username string) (string, error) {
-	secretKey := os.Getenv("SECRETKEY")
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"username": username,
-		"exp":      time.Now().Add((time.Hour * 24) * 30).Unix(),
-	})
-	tokenString, err := token.SignedString([]byte(secretKey))
-	return tokenString, err
+
+func isInviteOnly(db *sqlx.DB) (bool, error) {
+	var inviteOnly string
+	err := db.QueryRow("SELECT value FROM settings WHERE key = 'inviteOnly'").Scan(&inviteOnly)
+	return inviteOnly == "true", err
 }
 
-func createAccessToken(username string) (string, error) {
-	secretKey := os.Getenv("SECRETKEY")
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+// mfa is true when the session was opened with a second factor
+func createAccessToken(db *sqlx.DB, username string, sessionID string, mfa bool) (string, error) {
+	now := time.Now()
+	return signing.Sign(db, jwt.MapClaims{
 		"username": username,
-		"exp":      time.Now().Add(time.Hour * 24).Unix(),
+		"sid":      sessionID,
+		"mfa":      mfa,
+		"iat":      now.Unix(),
+		"exp":      now.Add(time.Hour * 24).Unix(),
 	})
-	tokenString, err := token.SignedString([]byte(secretKey))
-	return tokenString, err
 }
 
 func VerifyUser(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
@@ -143,11 +236,22 @@ func VerifyUser(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
 		return
 	}
 
+	userKey := throttleKey("user", signin.Username)
+	if rejectIfLocked(w, db, userKey, throttleKey("ip", clientIP(r))) {
+		return
+	}
+
+	var userID int
 	var storedHash string
 
 	// Fetch the stored password hash and verification status from the database
 	// It's important to fetch the hash here, not generate a new one.
-	if err := db.QueryRow("SELECT password_hash FROM users WHERE username = ?", signin.Username).Scan(&storedHash); err != nil {
+	if err := db.QueryRow("SELECT id, password_hash FROM users WHERE username = ?", signin.Username).Scan(&userID, &storedHash); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			recordFailures(db, r, userKey, signin.Username)
+			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			return
+		}
 		log.Printf("Database fetch error for user %s: %v", signin.Username, err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
@@ -158,6 +262,7 @@ func VerifyUser(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
 	if err := bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(signin.Password)); err != nil {
 		// If passwords don't match or there's an error during comparison (e.g., bad hash format)
 		if err == bcrypt.ErrMismatchedHashAndPassword {
+			recordFailures(db, r, userKey, signin.Username)
 			http.Error(w, "Invalid credentials", http.StatusUnauthorized) // Incorrect password
 			return
 		}
@@ -165,26 +270,60 @@ func VerifyUser(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+	clearFailures(db, userKey)
 
 	// If we reach here, the password is correct and the user is verified.
-	refreshToken, err := createRefreshToken(signin.Username)
+	completeLogin(w, r, db, userID, signin.Username)
+}
+
+// completeLogin is called once the first factor is verified. With 2FA
+// enabled that is not enough, the client gets a challenge that has to be
+// completed at /api/user/verify_mfa.
+func completeLogin(w http.ResponseWriter, r *http.Request, db *sqlx.DB, userID int, username string) {
+	mfaEnabled, err := isMfaEnabled(db, userID)
 	if err != nil {
 		log.Println(err)
-		http.Error(w, "JWT ERROR", http.StatusInternalServerError)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	if mfaEnabled {
+		challenge, err := createMfaChallenge(db, userID)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "DB ERROR", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]any{
+			"mfa_required":  true,
+			"mfa_challenge": challenge,
+			"expires_in":    int(MFA_CHALLENGE_TTL.Seconds()),
+		})
 		return
 	}
 
-	// TODO : use secure in production
-	http.SetCookie(w, &http.Cookie{
-		Name:     "refresh_token",
-		Value:    refreshToken,
-		Path:     "/",
-		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode,
-		MaxAge:   60 * 60 * 24 * 30, // 30 days
-	})
+	issueLogin(w, r, db, userID, username, false)
+}
 
-	accessToken, err := createAccessToken(signin.Username)
+// issueLogin opens a new session and answers with the access token, the
+// refresh token is set as a cookie. Every session is also a refresh token family.
+func issueLogin(w http.ResponseWriter, r *http.Request, db *sqlx.DB, userID int, username string, mfa bool) {
+	sessionID, err := createSession(db, userID, r, mfa)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	refreshToken, err := issueRefreshToken(db, userID, sessionID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "DB ERROR", http.StatusInternalServerError)
+		return
+	}
+	setRefreshCookie(w, refreshToken)
+
+	accessToken, err := createAccessToken(db, username, sessionID, mfa)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "JWT ERROR", http.StatusInternalServerError)
@@ -196,5 +335,4 @@ func VerifyUser(w http.ResponseWriter, r *http.Request, db *sqlx.DB) {
 	json.NewEncoder(w).Encode(map[string]string{
 		"access_token": accessToken,
 	})
-
 }